@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+	"github.com/timonwong/prometheus-webhook-dingtalk/template"
+)
+
+// loadConfigAndTemplates loads the configuration file and the templates it
+// refers to, the same way as the server does.
+func loadConfigAndTemplates(configFile string) (*config.Config, *template.Template, error) {
+	conf, err := config.LoadFile(configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	tmpl, err := template.FromGlobs(!conf.NoBuiltinTemplate, conf.TemplatePaths()...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse templates: %w", err)
+	}
+	return conf, tmpl, nil
+}
+
+// checkConfig validates the configuration file and dry-renders every target
+// against sample firing and resolved notifications.
+func checkConfig(w io.Writer, configFile string) int {
+	fmt.Fprintf(w, "Checking %s\n", configFile)
+	conf, tmpl, err := loadConfigAndTemplates(configFile)
+	if err != nil {
+		fmt.Fprintf(w, "  FAILED: %s\n", err)
+		return 1
+	}
+	fmt.Fprintf(w, "  SUCCESS: found %d target(s) and %d route(s)\n", len(conf.Targets), len(conf.Routes))
+
+	names := make([]string, 0, len(conf.Targets))
+	for name := range conf.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	failed := false
+	for _, name := range names {
+		target := conf.Targets[name]
+		if _, err := notifier.NewHTTPClient(conf.GetHTTPClientConfig(&target)); err != nil {
+			fmt.Fprintf(w, "  FAILED: target %q: %s\n", name, err)
+			failed = true
+			continue
+		}
+
+		builder := notifier.NewDingNotificationBuilder(tmpl, conf, &target)
+		for _, status := range []model.AlertStatus{model.AlertFiring, model.AlertResolved} {
+			notifications, err := builder.Build(context.Background(), models.NewSampleWebhookMessage(string(status), now))
+			if err != nil {
+				fmt.Fprintf(w, "  FAILED: target %q (%s): %s\n", name, status, err)
+				failed = true
+				continue
+			}
+			fmt.Fprintf(w, "  SUCCESS: target %q (%s) rendered %d notification(s)\n", name, status, len(notifications))
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -8,9 +8,12 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
@@ -21,12 +24,32 @@ import (
 	"github.com/timonwong/prometheus-webhook-dingtalk/web"
 )
 
+func init() {
+	prometheus.MustRegister(version.NewCollector("prometheus_webhook_dingtalk"))
+}
+
 func main() {
 	os.Exit(run())
 }
 
 func run() int {
+	kingpin.Command("server", "Run the webhook server.").Default()
+
 	var (
+		checkConfigCmd = kingpin.Command("check-config", "Check the configuration file and templates, and dry-render every target against sample alerts.")
+
+		renderCmd     = kingpin.Command("render", "Print the DingTalk notifications a target produces for an alert JSON file.")
+		renderName    = renderCmd.Arg("target", "Name of the target.").Required().String()
+		renderAlert   = renderCmd.Arg("alert-file", "Path to the alert JSON, read from stdin if omitted or \"-\".").String()
+		renderDecoder = renderCmd.Flag("decoder", "Decoder of the alert JSON, defaults to the one of the target.").String()
+
+		sendTestCmd  = kingpin.Command("send-test", "Fire a synthetic firing and then resolved alert at a target.")
+		sendTestName = sendTestCmd.Arg("target", "Name of the target.").Required().String()
+
+		replayCmd   = kingpin.Command("replay", "Send captured Alertmanager webhook messages to a target through the current templates.")
+		replayName  = replayCmd.Arg("target", "Name of the target.").Required().String()
+		replayAlert = replayCmd.Arg("alert-file", "Path to the webhook messages, as a JSON array or one after another, read from stdin if omitted or \"-\".").String()
+
 		listenAddress = kingpin.Flag(
 			"web.listen-address",
 			"The address to listen on for web interface.",
@@ -39,11 +62,36 @@ func run() int {
 			"web.enable-lifecycle",
 			"Enable reload via HTTP request.",
 		).Default("false").Bool()
+		enableAdminAPI = kingpin.Flag(
+			"web.enable-admin-api",
+			"Enable API endpoints that send test notifications or notifications of the history again.",
+		).Default("false").Bool()
+		webConfigFile = kingpin.Flag(
+			"web.config.file",
+			"Path to the configuration file that can enable TLS or basic authentication, compatible with the Prometheus exporter toolkit.",
+		).Default("").String()
 		configFile = kingpin.Flag(
 			"config.file",
 			"Path to the configuration file.",
 		).Default("config.yml").ExistingFile()
+		watchConfig = kingpin.Flag(
+			"config.watch",
+			"Reload the configuration automatically when the configuration file or templates change.",
+		).Default("false").Bool()
+		storagePath = kingpin.Flag(
+			"storage.path",
+			"Base path for on-disk state such as notification queues and history. Queueing and history are disabled when empty.",
+		).Default("").String()
+		historyMaxEntries = kingpin.Flag(
+			"storage.history.max-entries",
+			"Maximum number of notifications kept in the history, 0 means unlimited.",
+		).Default("10000").Int()
+		historyRetention model.Duration
 	)
+	kingpin.Flag(
+		"storage.history.retention",
+		"How long to keep notifications in the history, 0 means forever.",
+	).Default("7d").SetValue(&historyRetention)
 
 	// DO NOT REMOVE. For compatibility purpose
 	kingpin.Flag("web.ui-enabled", "").Hidden().BoolVar(enableWebUI)
@@ -53,9 +101,20 @@ func run() int {
 
 	kingpin.Version(version.Print("prometheus-webhook-dingtalk"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	logger := promlog.New(promlogConfig)
+	switch command {
+	case checkConfigCmd.FullCommand():
+		return checkConfig(os.Stdout, *configFile)
+	case renderCmd.FullCommand():
+		return render(os.Stdout, *configFile, *renderName, *renderAlert, *renderDecoder)
+	case sendTestCmd.FullCommand():
+		return sendTest(os.Stdout, logger, *configFile, *sendTestName)
+	case replayCmd.FullCommand():
+		return replay(os.Stdout, logger, *configFile, *replayName, *replayAlert)
+	}
+
 	level.Info(logger).Log("msg", "Starting prometheus-webhook-dingtalk", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", version.BuildContext())
 
@@ -75,10 +134,19 @@ func run() int {
 		flagsMap[f.Name] = f.Value.String()
 	}
 
+	configLogger := log.With(logger, "component", "configuration")
+	configCoordinator := config.NewCoordinator(*configFile, prometheus.DefaultRegisterer, configLogger)
+
 	webHandler := web.New(log.With(logger, "component", "web"), &web.Options{
-		ListenAddress:   *listenAddress,
-		EnableWebUI:     *enableWebUI,
-		EnableLifecycle: *enableLifecycle,
+		ListenAddress:     *listenAddress,
+		EnableWebUI:       *enableWebUI,
+		EnableLifecycle:   *enableLifecycle,
+		EnableAdminAPI:    *enableAdminAPI,
+		StoragePath:       *storagePath,
+		HistoryRetention:  time.Duration(historyRetention),
+		HistoryMaxEntries: *historyMaxEntries,
+		WebConfigFile:     *webConfigFile,
+		Coordinator:       configCoordinator,
 		Version: &web.VersionInfo{
 			Version:   version.Version,
 			Revision:  version.Revision,
@@ -90,12 +158,10 @@ func run() int {
 		Flags: flagsMap,
 	})
 
-	configLogger := log.With(logger, "component", "configuration")
-	configCoordinator := config.NewCoordinator(*configFile, configLogger)
 	configCoordinator.Subscribe(func(conf *config.Config) error {
 		// Parse templates
-		level.Info(configLogger).Log("msg", "Loading templates", "templates", strings.Join(conf.Templates, ";"))
-		tmpl, err := template.FromGlobs(!conf.NoBuiltinTemplate, conf.Templates...)
+		level.Info(configLogger).Log("msg", "Loading templates", "templates", strings.Join(conf.TemplatePaths(), ";"))
+		tmpl, err := template.FromGlobs(!conf.NoBuiltinTemplate, conf.TemplatePaths()...)
 		if err != nil {
 			return fmt.Errorf("failed to parse templates: %w", err)
 		}
@@ -110,11 +176,19 @@ func run() int {
 		for name := range conf.Targets {
 			paths = append(paths, fmt.Sprintf("http://%s:%s/dingtalk/%s/send", host, port, name))
 		}
+		for name := range conf.Routes {
+			paths = append(paths, fmt.Sprintf("http://%s:%s/dingtalk/%s/send", host, port, name))
+		}
 		configLogger.Log("msg", "Webhook urls for prometheus alertmanager", "urls", strings.Join(paths, " "))
 
 		return webHandler.ApplyConfig(conf, tmpl)
 	})
 
+	var configWatcher *config.Watcher
+	if *watchConfig {
+		configWatcher = config.NewWatcher(configCoordinator, config.DefaultWatchDebounce, configLogger)
+	}
+
 	if err := configCoordinator.Reload(); err != nil {
 		return 1
 	}
@@ -122,6 +196,14 @@ func run() int {
 	ctxWeb, cancelWeb := context.WithCancel(context.Background())
 	defer cancelWeb()
 
+	if configWatcher != nil {
+		go func() {
+			if err := configWatcher.Run(ctxWeb); err != nil {
+				level.Error(configLogger).Log("msg", "Error watching configuration files", "err", err)
+			}
+		}()
+	}
+
 	srvCh := make(chan error, 1)
 	go func() {
 		defer close(srvCh)
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/decoder"
+)
+
+// render prints the DingTalk notifications the target would send for the
+// alerts read from alertFile, or from stdin if it is empty or "-". The alerts
+// are decoded by decoderName, or else by the decoder of the target.
+func render(w io.Writer, configFile, name, alertFile, decoderName string) int {
+	conf, tmpl, err := loadConfigAndTemplates(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	target, ok := conf.Targets[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "target %q not found\n", name)
+		return 1
+	}
+
+	r := os.Stdin
+	if alertFile != "" && alertFile != "-" {
+		f, err := os.Open(alertFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if decoderName == "" {
+		decoderName = target.Decoder
+	}
+	m, _, err := decoder.Decode(decoderName, body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to decode alert JSON: %s\n", err)
+		return 1
+	}
+
+	builder := notifier.NewDingNotificationBuilder(tmpl, conf, &target)
+	notifications, err := builder.Build(context.Background(), m)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to render notification: %s\n", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(notifications); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-kit/log"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/decoder"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// replay pushes the alerts captured in alertFile, or read from stdin if it is
+// empty or "-", through the current templates of the target and sends them.
+// The file holds either a JSON array of webhook messages, or messages one
+// after another such as in JSON Lines, decoded with the decoder of the target.
+func replay(w io.Writer, logger log.Logger, configFile, name, alertFile string) int {
+	conf, tmpl, err := loadConfigAndTemplates(configFile)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	target, ok := conf.Targets[name]
+	if !ok {
+		fmt.Fprintf(w, "target %q not found\n", name)
+		return 1
+	}
+
+	r := os.Stdin
+	if alertFile != "" && alertFile != "-" {
+		f, err := os.Open(alertFile)
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	messages, err := decodeWebhookMessages(r, target.Decoder)
+	if err != nil {
+		fmt.Fprintf(w, "failed to decode alert JSON: %s\n", err)
+		return 1
+	}
+
+	httpClient, err := notifier.NewHTTPClient(conf.GetHTTPClientConfig(&target))
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	builder := notifier.NewDingNotificationBuilder(tmpl, conf, &target)
+	retry := conf.GetRetryConfig(&target)
+	failed := false
+	for i := range messages {
+		m := &messages[i]
+		notifications, err := builder.Build(ctx, m)
+		if err != nil {
+			fmt.Fprintf(w, "  FAILED: message %d (%s %s): failed to render notification: %s\n", i+1, m.Status, m.GroupKey, err)
+			failed = true
+			continue
+		}
+
+		for _, notification := range notifications {
+			robotResp, _, err := notifier.SendNotificationWithRetry(ctx, logger, notification, httpClient, &target, retry)
+			switch {
+			case err != nil:
+				fmt.Fprintf(w, "  FAILED: message %d (%s %s): %s\n", i+1, m.Status, m.GroupKey, err)
+				failed = true
+			case robotResp.ErrorCode != 0:
+				fmt.Fprintf(w, "  FAILED: message %d (%s %s): errcode=%d errmsg=%q\n", i+1, m.Status, m.GroupKey, robotResp.ErrorCode, robotResp.ErrorMessage)
+				failed = true
+			default:
+				fmt.Fprintf(w, "  SUCCESS: message %d (%s %s): errcode=%d errmsg=%q\n", i+1, m.Status, m.GroupKey, robotResp.ErrorCode, robotResp.ErrorMessage)
+			}
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// decodeWebhookMessages decodes a JSON array of webhook messages, or a stream
+// of them, with the named decoder.
+func decodeWebhookMessages(r io.Reader, decoderName string) ([]models.WebhookMessage, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var payloads []json.RawMessage
+	if b = bytes.TrimSpace(b); bytes.HasPrefix(b, []byte("[")) {
+		if err := json.Unmarshal(b, &payloads); err != nil {
+			return nil, err
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		for {
+			var payload json.RawMessage
+			err := dec.Decode(&payload)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			payloads = append(payloads, payload)
+		}
+	}
+
+	messages := make([]models.WebhookMessage, 0, len(payloads))
+	for _, payload := range payloads {
+		m, _, err := decoder.Decode(decoderName, payload)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *m)
+	}
+	return messages, nil
+}
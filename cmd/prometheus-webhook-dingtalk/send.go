@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/go-kit/log"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
+)
+
+// sendTest fires a synthetic alert at the target and reports the DingTalk
+// responses.
+func sendTest(w io.Writer, logger log.Logger, configFile, name string) int {
+	conf, tmpl, err := loadConfigAndTemplates(configFile)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	target, ok := conf.Targets[name]
+	if !ok {
+		fmt.Fprintf(w, "target %q not found\n", name)
+		return 1
+	}
+
+	httpClient, err := notifier.NewHTTPClient(conf.GetHTTPClientConfig(&target))
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	results, err := notifier.SendTestNotifications(context.Background(), logger, tmpl, conf, &target, httpClient)
+	failed := err != nil
+	for _, result := range results {
+		if result.Success() {
+			fmt.Fprintf(w, "  SUCCESS: %s %s notification: errcode=%d errmsg=%q\n", result.Status, result.MessageType, result.ErrorCode, result.ErrorMessage)
+			continue
+		}
+		failed = true
+		if result.Error != "" {
+			fmt.Fprintf(w, "  FAILED: %s %s notification: %s\n", result.Status, result.MessageType, result.Error)
+		} else {
+			fmt.Fprintf(w, "  FAILED: %s %s notification: errcode=%d errmsg=%q\n", result.Status, result.MessageType, result.ErrorCode, result.ErrorMessage)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(w, "  FAILED: %s\n", err)
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
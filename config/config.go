@@ -4,17 +4,56 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v2"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/decoder"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
 )
 
 var (
 	DefaultConfig = Config{
-		Timeout: 5 * time.Second,
+		Timeout:        5 * time.Second,
+		RequestTimeout: time.Minute,
+	}
+	DefaultTarget      = Target{}
+	DefaultRetryConfig = RetryConfig{
+		MaxAttempts:    3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+	}
+	// DefaultSizeLimitConfig follows the markdown size limit of DingTalk robots.
+	DefaultSizeLimitConfig = SizeLimitConfig{
+		MaxBytes: 20000,
+		Strategy: SizeLimitStrategySplit,
+	}
+	DefaultDedupConfig = DedupConfig{
+		TTL: 5 * time.Minute,
+	}
+	// DefaultQueueMaxAge is how long queued notifications are retried by
+	// default, older ones are stale and can still be replayed from the
+	// history.
+	DefaultQueueMaxAge      = time.Hour
+	DefaultHTTPClientConfig = HTTPClientConfig{
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	// DefaultRateLimitConfig follows the limit of DingTalk custom robots.
+	DefaultRateLimitConfig = RateLimitConfig{
+		Limit:    20,
+		Interval: time.Minute,
+		Strategy: RateLimitStrategyDelay,
+		MaxDelay: 10 * time.Second,
+	}
+	DefaultCircuitBreakerConfig = CircuitBreakerConfig{
+		FailureThreshold: 5,
+		OpenTimeout:      time.Minute,
 	}
-	DefaultTarget        = Target{}
 	DefaultTargetMessage = TargetMessage{
 		Title: `{{ template "ding.link.title" . }}`,
 		Text:  `{{ template "ding.link.content" . }}`,
@@ -23,31 +62,92 @@ var (
 	TargetValidNameRE = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\-_]*$`)
 )
 
-func LoadFile(filename string) (*Config, error) {
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
-
+// Load parses the YAML input s into a Config.
+func Load(s string) (*Config, error) {
 	cfg := &Config{}
 	// If the entire config body is empty the UnmarshalYAML method is
 	// never called. We thus have to set the DefaultConfig at the entry
 	// point as well.
 	*cfg = DefaultConfig
-	err = yaml.UnmarshalStrict(content, cfg)
+	err := yaml.UnmarshalStrict([]byte(s), cfg)
 	if err != nil {
 		return nil, err
 	}
 	return cfg, nil
 }
 
+// LoadFile parses the given YAML file into a Config. Files referred to by the
+// configuration are read as well, relative paths are resolved against the
+// directory of the configuration file.
+func LoadFile(filename string) (*Config, error) {
+	cfg, _, err := loadFile(filename)
+	return cfg, err
+}
+
+// loadFile is like LoadFile but also returns the content of the file, which is
+// available even if it fails to parse.
+func loadFile(filename string) (*Config, []byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := Load(string(content))
+	if err != nil {
+		return nil, content, err
+	}
+	if err := cfg.readFiles(filepath.Dir(filename)); err != nil {
+		return nil, content, err
+	}
+	return cfg, content, nil
+}
+
+// readFiles reads the URLs and secrets of the targets which refer to files,
+// and resolves the paths of the other files.
+func (c *Config) readFiles(dir string) error {
+	if c.HTTPConfig != nil {
+		c.HTTPConfig.TLSConfig.setDirectory(dir)
+	}
+	c.templatePaths = make([]string, 0, len(c.Templates))
+	for _, tp := range c.Templates {
+		c.templatePaths = append(c.templatePaths, resolveTemplate(dir, tp))
+	}
+	for name, target := range c.Targets {
+		if err := target.readFiles(dir); err != nil {
+			return fmt.Errorf("target %q: %w", name, err)
+		}
+		c.Targets[name] = target
+	}
+	return nil
+}
+
 type Config struct {
-	NoBuiltinTemplate bool              `yaml:"no_builtin_template"`
-	Template          string            `yaml:"template,omitempty"`
-	Templates         []string          `yaml:"templates,omitempty"`
-	DefaultMessage    *TargetMessage    `yaml:"default_message,omitempty"`
-	Timeout           time.Duration     `yaml:"timeout"`
-	Targets           map[string]Target `yaml:"targets"`
+	NoBuiltinTemplate bool           `yaml:"no_builtin_template"`
+	Template          string         `yaml:"template,omitempty"`
+	Templates         []string       `yaml:"templates,omitempty"`
+	DefaultMessage    *TargetMessage `yaml:"default_message,omitempty"`
+	// Timeout bounds each request to DingTalk, unless the HTTP client
+	// settings of the target have their own.
+	Timeout time.Duration `yaml:"timeout"`
+	// RequestTimeout bounds the handling of a webhook as a whole, including
+	// rate limit delays, retries and fallback targets.
+	RequestTimeout time.Duration         `yaml:"request_timeout"`
+	Retry          *RetryConfig          `yaml:"retry,omitempty"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker,omitempty"`
+	SizeLimit      *SizeLimitConfig      `yaml:"size_limit,omitempty"`
+	HTTPConfig     *HTTPClientConfig     `yaml:"http_config,omitempty"`
+	Targets        map[string]Target     `yaml:"targets"`
+	// Routes dispatch alerts to targets by their labels, they are reachable
+	// the same way as targets.
+	Routes map[string]*Route `yaml:"routes,omitempty"`
+	// Directory maps label values, such as owners or teams, to the people
+	// to mention.
+	Directory map[string]DirectoryEntry `yaml:"directory,omitempty"`
+	// Dedup suppresses identical notifications, it is disabled when nil.
+	Dedup *DedupConfig `yaml:"dedup,omitempty"`
+
+	// templatePaths are the template globs resolved by LoadFile.
+	templatePaths []string
 }
 
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -60,10 +160,42 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
-	for name := range c.Targets {
+	if err := c.checkRequestTimeout("global", c.GetHTTPClientConfig(&Target{}).Timeout, c.Retry, nil); err != nil {
+		return err
+	}
+	for name, target := range c.Targets {
 		if !TargetValidNameRE.MatchString(name) {
 			return fmt.Errorf("invalid target name: %q", name)
 		}
+		if err := c.checkRequestTimeout(fmt.Sprintf("target %q", name), c.GetHTTPClientConfig(&target).Timeout, target.Retry, target.RateLimit); err != nil {
+			return err
+		}
+		for _, fallback := range target.Fallback {
+			if _, ok := c.Targets[fallback]; !ok {
+				return fmt.Errorf("undefined fallback target %q used in target %q", fallback, name)
+			}
+			if fallback == name {
+				return fmt.Errorf("target %q cannot be its own fallback", name)
+			}
+		}
+	}
+
+	for name, route := range c.Routes {
+		if !TargetValidNameRE.MatchString(name) {
+			return fmt.Errorf("invalid route name: %q", name)
+		}
+		if _, ok := c.Targets[name]; ok {
+			return fmt.Errorf("route name %q conflicts with a target", name)
+		}
+		if route == nil {
+			return fmt.Errorf("route %q is empty", name)
+		}
+		if err := validateDecoder(route.Decoder); err != nil {
+			return fmt.Errorf("route %q: %w", name, err)
+		}
+		if err := route.validate(c.Targets, false); err != nil {
+			return fmt.Errorf("route %q: %w", name, err)
+		}
 	}
 
 	if c.Template != "" {
@@ -73,6 +205,25 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// checkRequestTimeout makes sure that a single request to DingTalk, retry
+// backoff or rate limit delay cannot use up the request timeout on its own,
+// which would turn slow, delayed or retried notifications into timeouts.
+func (c *Config) checkRequestTimeout(scope string, timeout time.Duration, retry *RetryConfig, rateLimit *RateLimitConfig) error {
+	if c.RequestTimeout <= 0 {
+		return nil
+	}
+	if timeout > c.RequestTimeout {
+		return fmt.Errorf("%s: timeout (%s) must not exceed request_timeout (%s)", scope, timeout, c.RequestTimeout)
+	}
+	if retry != nil && retry.MaxAttempts > 1 && retry.MaxBackoff >= c.RequestTimeout {
+		return fmt.Errorf("%s: retry max_backoff (%s) must be less than request_timeout (%s)", scope, retry.MaxBackoff, c.RequestTimeout)
+	}
+	if rateLimit != nil && rateLimit.Strategy == RateLimitStrategyDelay && rateLimit.MaxDelay >= c.RequestTimeout {
+		return fmt.Errorf("%s: rate_limit max_delay (%s) must be less than request_timeout (%s)", scope, rateLimit.MaxDelay, c.RequestTimeout)
+	}
+	return nil
+}
+
 func (c *Config) String() string {
 	b, err := yaml.Marshal(c)
 	if err != nil {
@@ -81,6 +232,40 @@ func (c *Config) String() string {
 	return string(b)
 }
 
+// GetAuthConfig returns the inbound auth configuration of the target or route
+// with the given name, or nil if there is none.
+func (c *Config) GetAuthConfig(name string) *AuthConfig {
+	if target, ok := c.Targets[name]; ok {
+		return target.Auth
+	}
+	if route, ok := c.Routes[name]; ok {
+		return route.Auth
+	}
+	return nil
+}
+
+// GetDecoder returns the decoder of the payloads posted to the target or
+// route with the given name, empty for the default one.
+func (c *Config) GetDecoder(name string) string {
+	if target, ok := c.Targets[name]; ok {
+		return target.Decoder
+	}
+	if route, ok := c.Routes[name]; ok {
+		return route.Decoder
+	}
+	return ""
+}
+
+func validateDecoder(name string) error {
+	if name == "" || name == decoder.Auto {
+		return nil
+	}
+	if _, ok := decoder.Lookup(name); !ok {
+		return fmt.Errorf("unknown decoder %q, must be one of %s or %s", name, strings.Join(decoder.Names(), ", "), decoder.Auto)
+	}
+	return nil
+}
+
 func (c *Config) GetDefaultMessage() TargetMessage {
 	if c.DefaultMessage != nil {
 		return *c.DefaultMessage
@@ -88,11 +273,97 @@ func (c *Config) GetDefaultMessage() TargetMessage {
 	return DefaultTargetMessage
 }
 
+// GetRetryConfig returns the retry settings for the given target.
+func (c *Config) GetRetryConfig(target *Target) RetryConfig {
+	// Retry settings from the following order:
+	//   target level > config global level > no retry
+	if target.Retry != nil {
+		return *target.Retry
+	}
+	if c.Retry != nil {
+		return *c.Retry
+	}
+	return RetryConfig{MaxAttempts: 1}
+}
+
+// GetCircuitBreakerConfig returns the circuit breaker settings for the given
+// target, or nil if it has none.
+func (c *Config) GetCircuitBreakerConfig(target *Target) *CircuitBreakerConfig {
+	// Circuit breaker settings from the following order:
+	//   target level > config global level > disabled
+	if target.CircuitBreaker != nil {
+		return target.CircuitBreaker
+	}
+	return c.CircuitBreaker
+}
+
+// GetHTTPClientConfig returns the HTTP client settings for the given target.
+func (c *Config) GetHTTPClientConfig(target *Target) HTTPClientConfig {
+	// HTTP client settings from the following order:
+	//   target level > config global level > builtin global level
+	var cfg HTTPClientConfig
+	switch {
+	case target.HTTPConfig != nil:
+		cfg = *target.HTTPConfig
+	case c.HTTPConfig != nil:
+		cfg = *c.HTTPConfig
+	default:
+		cfg = DefaultHTTPClientConfig
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = c.Timeout
+	}
+	return cfg
+}
+
+// GetSizeLimitConfig returns the message size limit settings for the given target.
+func (c *Config) GetSizeLimitConfig(target *Target) SizeLimitConfig {
+	// Size limit settings from the following order:
+	//   target level > config global level > builtin global level
+	if target.SizeLimit != nil {
+		return *target.SizeLimit
+	}
+	if c.SizeLimit != nil {
+		return *c.SizeLimit
+	}
+	return DefaultSizeLimitConfig
+}
+
 type Target struct {
-	URL     *SecretURL     `yaml:"url,omitempty"`
-	Secret  Secret         `yaml:"secret,omitempty"`
-	Mention *TargetMention `yaml:"mention,omitempty"`
-	Message *TargetMessage `yaml:"message,omitempty"`
+	URL    *SecretURL `yaml:"url,omitempty"`
+	Secret Secret     `yaml:"secret,omitempty"`
+	// URLFile and SecretFile are read instead of URL and Secret, they are
+	// re-read on every reload. Relative paths are resolved against the
+	// directory of the configuration file into urlFile and secretFile.
+	URLFile    string `yaml:"url_file,omitempty"`
+	SecretFile string `yaml:"secret_file,omitempty"`
+	urlFile    string
+	secretFile string
+	Mention    *TargetMention `yaml:"mention,omitempty"`
+	Message    *TargetMessage `yaml:"message,omitempty"`
+	Retry      *RetryConfig   `yaml:"retry,omitempty"`
+	// CircuitBreaker stops sending to the target for a while when it keeps
+	// failing, it is disabled when neither set here nor globally.
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker,omitempty"`
+	// Queue enables asynchronous delivery through the on-disk queue.
+	Queue bool `yaml:"queue,omitempty"`
+	// QueueMaxAge is how long queued notifications are retried before being
+	// handed over to the fallbacks, DefaultQueueMaxAge when zero.
+	QueueMaxAge time.Duration    `yaml:"queue_max_age,omitempty"`
+	RateLimit   *RateLimitConfig `yaml:"rate_limit,omitempty"`
+	SizeLimit   *SizeLimitConfig `yaml:"size_limit,omitempty"`
+	// PerAlert sends one message per alert instead of one per group.
+	PerAlert bool `yaml:"per_alert,omitempty"`
+	// Auth restricts who may post to the target, it takes precedence over
+	// the users of the web configuration file.
+	Auth       *AuthConfig       `yaml:"auth,omitempty"`
+	HTTPConfig *HTTPClientConfig `yaml:"http_config,omitempty"`
+	// Fallback lists the targets tried in order when a notification cannot
+	// be delivered to this one, their own fallbacks are not followed.
+	Fallback []string `yaml:"fallback,omitempty"`
+	// Decoder decodes the payloads posted to the target, it defaults to
+	// alertmanager. Payloads are sniffed when it is auto.
+	Decoder string `yaml:"decoder,omitempty"`
 }
 
 func (c *Target) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -105,21 +376,211 @@ func (c *Target) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
-	if c.URL == nil {
+	if c.URL == nil && c.URLFile == "" {
 		return errors.New("url cannot be empty")
 	}
+	if c.URL != nil && c.URLFile != "" {
+		return errors.New("at most one of url and url_file must be configured")
+	}
+	if c.Secret != "" && c.SecretFile != "" {
+		return errors.New("at most one of secret and secret_file must be configured")
+	}
+	if err := validateDecoder(c.Decoder); err != nil {
+		return err
+	}
+	if c.QueueMaxAge < 0 {
+		return errors.New("queue_max_age cannot be negative")
+	}
 
 	return nil
 }
 
+// GetQueueMaxAge returns how long queued notifications are retried.
+func (c *Target) GetQueueMaxAge() time.Duration {
+	if c.QueueMaxAge > 0 {
+		return c.QueueMaxAge
+	}
+	return DefaultQueueMaxAge
+}
+
+// readFiles reads URLFile and SecretFile, relative paths are resolved
+// against dir.
+func (c *Target) readFiles(dir string) error {
+	if c.HTTPConfig != nil {
+		c.HTTPConfig.TLSConfig.setDirectory(dir)
+	}
+
+	if c.URLFile != "" {
+		c.urlFile = JoinDir(dir, c.URLFile)
+		content, err := os.ReadFile(c.urlFile)
+		if err != nil {
+			return fmt.Errorf("unable to read url_file: %w", err)
+		}
+		u, err := ParseURL(strings.TrimSpace(string(content)))
+		if err != nil {
+			return fmt.Errorf("invalid URL in url_file %q: %w", c.URLFile, err)
+		}
+		c.URL = (*SecretURL)(u)
+	}
+
+	if c.SecretFile != "" {
+		c.secretFile = JoinDir(dir, c.SecretFile)
+		content, err := os.ReadFile(c.secretFile)
+		if err != nil {
+			return fmt.Errorf("unable to read secret_file: %w", err)
+		}
+		c.Secret = Secret(strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+// resolveTemplate resolves a relative template glob against dir, unless it
+// matches nothing there, in which case it is kept relative to the working
+// directory, where it used to be resolved.
+func resolveTemplate(dir, glob string) string {
+	resolved := JoinDir(dir, glob)
+	if matches, err := filepath.Glob(resolved); err == nil && len(matches) > 0 {
+		return resolved
+	}
+	return glob
+}
+
+// TemplatePaths returns the template globs, resolved against the directory of
+// the configuration file when it was loaded with LoadFile.
+func (c *Config) TemplatePaths() []string {
+	if c.templatePaths != nil {
+		return c.templatePaths
+	}
+	return c.Templates
+}
+
+// files returns the files the target reads its URL and secret from, resolved
+// against the directory of the configuration file.
+func (c *Target) files() []string {
+	var files []string
+	for _, f := range []string{c.urlFile, c.secretFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// JoinDir resolves a relative path against dir, empty and absolute paths are
+// returned as is.
+func JoinDir(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// AuthConfig holds the credentials accepted from inbound requests, either
+// basic auth users or bearer tokens.
+type AuthConfig struct {
+	// BasicAuthUsers maps usernames to bcrypt hashed passwords.
+	BasicAuthUsers map[string]Secret `yaml:"basic_auth_users,omitempty"`
+	BearerTokens   []Secret          `yaml:"bearer_tokens,omitempty"`
+}
+
+func (c *AuthConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AuthConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if len(c.BasicAuthUsers) == 0 && len(c.BearerTokens) == 0 {
+		return errors.New("auth requires at least one of basic_auth_users and bearer_tokens")
+	}
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash for user %q: %w", user, err)
+		}
+	}
+	for _, token := range c.BearerTokens {
+		if token == "" {
+			return errors.New("bearer token cannot be empty")
+		}
+	}
+	return nil
+}
+
 type TargetMention struct {
 	All     bool     `yaml:"all,omitempty"`
 	Mobiles []string `yaml:"mobiles,omitempty"`
+	UserIDs []string `yaml:"user_ids,omitempty"`
+	// MobilesTemplate is rendered at send time into a list of mobiles
+	// separated by commas or whitespaces.
+	MobilesTemplate string `yaml:"mobiles_template,omitempty"`
+	// UserIDsTemplate is rendered at send time into a list of DingTalk
+	// userIds separated by commas or whitespaces.
+	UserIDsTemplate string `yaml:"user_ids_template,omitempty"`
+	// Labels whose values are looked up in the directory.
+	Labels []string `yaml:"labels,omitempty"`
+	// Rules add mentions when one of the alerts matches them.
+	Rules []MentionRule `yaml:"rules,omitempty"`
+}
+
+// MentionRule adds mentions if at least one alert with the given status
+// matches all matchers, e.g. @all only for firing critical alerts.
+type MentionRule struct {
+	Matchers Matchers `yaml:"matchers,omitempty"`
+	// Status of the alerts to match, either firing or resolved. Alerts of
+	// any status are matched when empty.
+	Status  string   `yaml:"status,omitempty"`
+	All     bool     `yaml:"all,omitempty"`
+	Mobiles []string `yaml:"mobiles,omitempty"`
+	UserIDs []string `yaml:"user_ids,omitempty"`
+}
+
+func (c *MentionRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain MentionRule
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	switch c.Status {
+	case "", "firing", "resolved":
+	default:
+		return fmt.Errorf("invalid mention rule status: %q", c.Status)
+	}
+
+	return nil
+}
+
+// DirectoryEntry holds the contacts of a person or a group of people.
+type DirectoryEntry struct {
+	Mobiles []string `yaml:"mobiles,omitempty"`
+	UserIDs []string `yaml:"user_ids,omitempty"`
 }
 
 type TargetMessage struct {
+	// Type is the DingTalk message type, markdown by default.
+	Type  string `yaml:"type,omitempty"`
 	Title string `yaml:"title"`
 	Text  string `yaml:"text"`
+
+	// Fields of link messages.
+	MessageURL string `yaml:"message_url,omitempty"`
+	PictureURL string `yaml:"picture_url,omitempty"`
+
+	// Fields of actionCard messages.
+	HideAvatar        bool                  `yaml:"hide_avatar,omitempty"`
+	ButtonOrientation string                `yaml:"button_orientation,omitempty"`
+	SingleTitle       string                `yaml:"single_title,omitempty"`
+	SingleURL         string                `yaml:"single_url,omitempty"`
+	Buttons           []TargetMessageButton `yaml:"buttons,omitempty"`
+
+	// Fields of feedCard messages.
+	Links []TargetMessageLink `yaml:"links,omitempty"`
+}
+
+// GetType returns the message type, defaulting to markdown.
+func (c *TargetMessage) GetType() string {
+	if c.Type == "" {
+		return models.MessageTypeMarkdown
+	}
+	return c.Type
 }
 
 func (c *TargetMessage) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -132,5 +593,257 @@ func (c *TargetMessage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	switch c.GetType() {
+	case models.MessageTypeMarkdown, models.MessageTypeText:
+	case models.MessageTypeLink:
+		if c.MessageURL == "" {
+			return errors.New("message_url cannot be empty for link messages")
+		}
+	case models.MessageTypeActionCard:
+		if len(c.Buttons) == 0 && (c.SingleTitle == "" || c.SingleURL == "") {
+			return errors.New("either buttons or single_title and single_url are required for actionCard messages")
+		}
+		switch c.ButtonOrientation {
+		case "", "vertical", "horizontal":
+		default:
+			return fmt.Errorf("invalid button_orientation: %q", c.ButtonOrientation)
+		}
+	case models.MessageTypeFeedCard:
+		if len(c.Links) == 0 {
+			return errors.New("links cannot be empty for feedCard messages")
+		}
+	default:
+		return fmt.Errorf("unknown message type: %q", c.Type)
+	}
+
 	return nil
 }
+
+// TargetMessageButton is a button of an actionCard message.
+type TargetMessageButton struct {
+	Title string `yaml:"title"`
+	URL   string `yaml:"url"`
+}
+
+// TargetMessageLink is a link of a feedCard message.
+type TargetMessageLink struct {
+	Title      string `yaml:"title"`
+	MessageURL string `yaml:"message_url"`
+	PictureURL string `yaml:"picture_url,omitempty"`
+}
+
+// RetryConfig configures how failed notifications are retried.
+type RetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+func (c *RetryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultRetryConfig
+	type plain RetryConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.MaxAttempts < 1 {
+		return errors.New("retry max_attempts must be at least 1")
+	}
+	if c.InitialBackoff <= 0 {
+		return errors.New("retry initial_backoff must be greater than 0")
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		return errors.New("retry max_backoff must not be less than initial_backoff")
+	}
+
+	return nil
+}
+
+// CircuitBreakerConfig configures when a failing target is given a rest.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures opening the circuit.
+	FailureThreshold int `yaml:"failure_threshold"`
+	// OpenTimeout is how long the circuit stays open before a notification is
+	// let through to probe whether the target recovered.
+	OpenTimeout time.Duration `yaml:"open_timeout"`
+}
+
+func (c *CircuitBreakerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultCircuitBreakerConfig
+	type plain CircuitBreakerConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.FailureThreshold < 1 {
+		return errors.New("circuit_breaker failure_threshold must be at least 1")
+	}
+	if c.OpenTimeout <= 0 {
+		return errors.New("circuit_breaker open_timeout must be greater than 0")
+	}
+
+	return nil
+}
+
+// Rate limit strategies.
+const (
+	// RateLimitStrategyDelay delays notifications until the limit allows sending them.
+	RateLimitStrategyDelay = "delay"
+	// RateLimitStrategyCoalesce merges notifications exceeding the limit into one.
+	RateLimitStrategyCoalesce = "coalesce"
+)
+
+// RateLimitConfig configures the token bucket limiting notifications sent to
+// a robot URL.
+type RateLimitConfig struct {
+	Limit    int           `yaml:"limit"`
+	Interval time.Duration `yaml:"interval"`
+	Strategy string        `yaml:"strategy"`
+	// MaxDelay is how long the delay strategy may hold a notification.
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+func (c *RateLimitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultRateLimitConfig
+	type plain RateLimitConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Limit < 1 {
+		return errors.New("rate_limit limit must be at least 1")
+	}
+	if c.Interval <= 0 {
+		return errors.New("rate_limit interval must be greater than 0")
+	}
+	switch c.Strategy {
+	case RateLimitStrategyDelay, RateLimitStrategyCoalesce:
+	default:
+		return fmt.Errorf("unknown rate_limit strategy: %q", c.Strategy)
+	}
+
+	return nil
+}
+
+// Size limit strategies.
+const (
+	// SizeLimitStrategySplit splits oversized messages on alert boundaries into
+	// several numbered messages.
+	SizeLimitStrategySplit = "split"
+	// SizeLimitStrategyTruncate drops the alerts which do not fit and appends a
+	// footer telling how many were left out.
+	SizeLimitStrategyTruncate = "truncate"
+)
+
+// SizeLimitConfig configures how messages exceeding the DingTalk size limit
+// are handled.
+type SizeLimitConfig struct {
+	// MaxBytes bounds the whole JSON payload sent to DingTalk.
+	MaxBytes int    `yaml:"max_bytes"`
+	Strategy string `yaml:"strategy"`
+}
+
+func (c *SizeLimitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultSizeLimitConfig
+	type plain SizeLimitConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.MaxBytes < 1024 {
+		return errors.New("size_limit max_bytes must be at least 1024")
+	}
+	switch c.Strategy {
+	case SizeLimitStrategySplit, SizeLimitStrategyTruncate:
+	default:
+		return fmt.Errorf("unknown size_limit strategy: %q", c.Strategy)
+	}
+
+	return nil
+}
+
+// DedupConfig configures the suppression of repeated notifications.
+type DedupConfig struct {
+	// TTL is how long an identical payload is suppressed after it was sent.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c *DedupConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultDedupConfig
+	type plain DedupConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.TTL <= 0 {
+		return errors.New("dedup ttl must be greater than 0")
+	}
+
+	return nil
+}
+
+// HTTPClientConfig configures the HTTP client talking to DingTalk.
+type HTTPClientConfig struct {
+	// ProxyURL is the HTTP or SOCKS5 proxy to connect through, the proxy is
+	// taken from the environment when empty.
+	ProxyURL  *ProxyURL `yaml:"proxy_url,omitempty"`
+	TLSConfig TLSConfig `yaml:"tls_config,omitempty"`
+	// Timeout of a request, defaults to the global timeout.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// KeepAlive reuses connections between requests.
+	KeepAlive           bool          `yaml:"keep_alive,omitempty"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout,omitempty"`
+}
+
+func (c *HTTPClientConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultHTTPClientConfig
+	type plain HTTPClientConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Timeout < 0 {
+		return errors.New("http_config timeout must not be negative")
+	}
+	if c.MaxIdleConnsPerHost < 0 {
+		return errors.New("http_config max_idle_conns_per_host must not be negative")
+	}
+	if c.IdleConnTimeout < 0 {
+		return errors.New("http_config idle_conn_timeout must not be negative")
+	}
+
+	return nil
+}
+
+// TLSConfig configures the TLS connections to DingTalk.
+type TLSConfig struct {
+	// CAFile is the CA certificate to verify the server with, instead of the
+	// system certificates.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// CertFile and KeyFile are the client certificate and key.
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+func (c *TLSConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TLSConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("tls_config requires both cert_file and key_file")
+	}
+
+	return nil
+}
+
+// setDirectory resolves relative file paths against dir.
+func (c *TLSConfig) setDirectory(dir string) {
+	c.CAFile = JoinDir(dir, c.CAFile)
+	c.CertFile = JoinDir(dir, c.CertFile)
+	c.KeyFile = JoinDir(dir, c.KeyFile)
+}
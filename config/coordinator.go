@@ -14,12 +14,28 @@
 package config
 
 import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
 	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// maxReloadHistory is the number of reload attempts kept by the Coordinator.
+const maxReloadHistory = 20
+
+// ReloadEvent records the outcome of a single configuration reload attempt.
+type ReloadEvent struct {
+	Time       time.Time `json:"time"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	ConfigHash string    `json:"configHash,omitempty"`
+}
+
 // Coordinator coordinates configurations beyond the lifetime of a
 // single configuration.
 type Coordinator struct {
@@ -30,20 +46,54 @@ type Coordinator struct {
 	mutex       sync.Mutex
 	config      *Config
 	subscribers []func(*Config) error
+
+	// Protects history and lastSuccess
+	historyMtx  sync.RWMutex
+	history     []ReloadEvent
+	lastSuccess *ReloadEvent
+
+	configHashMetric        prometheus.Gauge
+	configSuccessMetric     prometheus.Gauge
+	configSuccessTimeMetric prometheus.Gauge
 }
 
 // NewCoordinator returns a new coordinator with the given configuration file
 // path. It does not yet load the configuration from file. This is done in
 // `Reload()`.
-func NewCoordinator(configFilePath string, l log.Logger) *Coordinator {
+func NewCoordinator(configFilePath string, r prometheus.Registerer, l log.Logger) *Coordinator {
 	c := &Coordinator{
 		configFilePath: configFilePath,
 		logger:         l,
 	}
 
+	c.registerMetrics(r)
+
 	return c
 }
 
+func (c *Coordinator) registerMetrics(r prometheus.Registerer) {
+	configHash := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dingtalk_config_hash",
+		Help: "Hash of the currently loaded dingtalk configuration.",
+	})
+	configSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dingtalk_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	configSuccessTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dingtalk_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+
+	if r != nil {
+		r.MustRegister(configHash, configSuccess, configSuccessTime)
+	}
+
+	c.configHashMetric = configHash
+	c.configSuccessMetric = configSuccess
+	c.configSuccessTimeMetric = configSuccessTime
+}
+
 // Subscribe subscribes the given Subscribers to configuration changes.
 func (c *Coordinator) Subscribe(ss ...func(*Config) error) {
 	c.mutex.Lock()
@@ -52,9 +102,9 @@ func (c *Coordinator) Subscribe(ss ...func(*Config) error) {
 	c.subscribers = append(c.subscribers, ss...)
 }
 
-func (c *Coordinator) notifySubscribers() error {
+func (c *Coordinator) notifySubscribers(conf *Config) error {
 	for _, s := range c.subscribers {
-		if err := s(c.config); err != nil {
+		if err := s(conf); err != nil {
 			return err
 		}
 	}
@@ -62,38 +112,117 @@ func (c *Coordinator) notifySubscribers() error {
 	return nil
 }
 
-// loadFromFile triggers a configuration load, discarding the old configuration.
-func (c *Coordinator) loadFromFile() error {
-	conf, err := LoadFile(c.configFilePath)
-	if err != nil {
-		return err
+// loadFromFile loads the configuration from file, along with the hash of the
+// file content, which is returned even when parsing fails.
+func (c *Coordinator) loadFromFile() (*Config, string, error) {
+	conf, content, err := loadFile(c.configFilePath)
+	if content == nil {
+		return nil, "", err
 	}
 
-	c.config = conf
-	return nil
+	hash := md5.Sum(content)
+	return conf, hex.EncodeToString(hash[:]), err
 }
 
 // Reload triggers a configuration reload from file and notifies all
-// configuration change subscribers.
+// configuration change subscribers. The previous configuration is kept when
+// the new one fails to load or to apply.
 func (c *Coordinator) Reload() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	logger := log.With(c.logger, "file", c.configFilePath)
 	level.Info(logger).Log("msg", "Loading configuration file")
-	if err := c.loadFromFile(); err != nil {
+	conf, hash, err := c.loadFromFile()
+	if err != nil {
 		level.Error(logger).Log(
 			"msg", "Loading configuration file failed",
 			"err", err,
 		)
+		c.recordReload(hash, err)
 		return err
 	}
 	level.Info(logger).Log("msg", "Completed loading of configuration file")
 
-	if err := c.notifySubscribers(); err != nil {
+	if err := c.notifySubscribers(conf); err != nil {
 		logger.Log("msg", "one or more config change subscribers failed to apply new config", "err", err)
+		c.recordReload(hash, err)
 		return err
 	}
 
+	c.config = conf
+	c.recordReload(hash, nil)
 	return nil
 }
+
+// recordReload appends the outcome of a reload attempt to the history and
+// updates the metrics accordingly.
+func (c *Coordinator) recordReload(hash string, err error) {
+	event := ReloadEvent{
+		Time:       time.Now(),
+		Success:    err == nil,
+		ConfigHash: hash,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	c.historyMtx.Lock()
+	defer c.historyMtx.Unlock()
+
+	c.history = append(c.history, event)
+	if len(c.history) > maxReloadHistory {
+		c.history = c.history[len(c.history)-maxReloadHistory:]
+	}
+
+	if err != nil {
+		c.configSuccessMetric.Set(0)
+		return
+	}
+
+	c.lastSuccess = &event
+	c.configHashMetric.Set(hashAsMetricValue(hash))
+	c.configSuccessMetric.Set(1)
+	c.configSuccessTimeMetric.SetToCurrentTime()
+}
+
+// ReloadHistory returns the most recent reload attempts, newest first.
+func (c *Coordinator) ReloadHistory() []ReloadEvent {
+	c.historyMtx.RLock()
+	defer c.historyMtx.RUnlock()
+
+	history := make([]ReloadEvent, 0, len(c.history))
+	for i := len(c.history) - 1; i >= 0; i-- {
+		history = append(history, c.history[i])
+	}
+	return history
+}
+
+// LastReload returns the latest reload attempt and the latest successful one,
+// they are nil if there was none yet.
+func (c *Coordinator) LastReload() (last, lastSuccess *ReloadEvent) {
+	c.historyMtx.RLock()
+	defer c.historyMtx.RUnlock()
+
+	if len(c.history) > 0 {
+		event := c.history[len(c.history)-1]
+		last = &event
+	}
+	if c.lastSuccess != nil {
+		event := *c.lastSuccess
+		lastSuccess = &event
+	}
+	return last, lastSuccess
+}
+
+// hashAsMetricValue converts the leading bytes of a hex encoded hash into a
+// float64 that fits into a metric sample.
+func hashAsMetricValue(hash string) float64 {
+	b, err := hex.DecodeString(hash)
+	if err != nil || len(b) < 6 {
+		return 0
+	}
+	var bytes = make([]byte, 8)
+	copy(bytes, b[:6])
+	return float64(binary.LittleEndian.Uint64(bytes))
+}
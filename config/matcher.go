@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MatchType is the type of a label matcher.
+type MatchType string
+
+// Possible match types.
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+var matcherRE = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+// Matcher matches a label value, using the same syntax as Alertmanager
+// matchers, e.g. `severity="critical"` or `team=~"db|infra"`.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// ParseMatcher parses a matcher from its string representation.
+func ParseMatcher(s string) (*Matcher, error) {
+	ms := matcherRE.FindStringSubmatch(s)
+	if ms == nil {
+		return nil, fmt.Errorf("bad matcher format: %s", s)
+	}
+
+	value := ms[3]
+	if strings.HasPrefix(value, `"`) {
+		var err error
+		value, err = strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad matcher value %s: %w", ms[3], err)
+		}
+	}
+
+	m := &Matcher{
+		Type:  MatchType(ms[2]),
+		Name:  ms[1],
+		Value: value,
+	}
+	if m.Type == MatchRegexp || m.Type == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("bad matcher regexp %q: %w", value, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+func (m *Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+// Matches returns whether the matcher matches the given label value.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	default:
+		return false
+	}
+}
+
+// MarshalYAML implements the yaml.Marshaler interface for Matcher.
+func (m *Matcher) MarshalYAML() (interface{}, error) {
+	return m.String(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for Matcher.
+func (m *Matcher) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := ParseMatcher(s)
+	if err != nil {
+		return err
+	}
+	*m = *parsed
+	return nil
+}
+
+// Matchers is a list of matchers which all have to match.
+type Matchers []*Matcher
+
+// Matches returns whether all matchers match the given labels. A missing label
+// is treated as an empty value.
+func (ms Matchers) Matches(labels map[string]string) bool {
+	for _, m := range ms {
+		if !m.Matches(labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Route is a node of a routing tree which dispatches alerts to targets based
+// on their labels, following the semantics of Alertmanager routes.
+type Route struct {
+	// Targets receiving the alerts matched by the route. Child routes inherit
+	// the targets of their parent when empty.
+	Targets  []string `yaml:"targets,omitempty"`
+	Matchers Matchers `yaml:"matchers,omitempty"`
+	// Continue defines whether matching goes on with the next sibling route
+	// after this route matched.
+	Continue bool     `yaml:"continue,omitempty"`
+	Routes   []*Route `yaml:"routes,omitempty"`
+	// Auth restricts who may post to the route, like the auth of targets.
+	// It is only allowed on top-level routes.
+	Auth *AuthConfig `yaml:"auth,omitempty"`
+	// Decoder decodes the payloads posted to the route, like the decoder of
+	// targets. It is only allowed on top-level routes.
+	Decoder string `yaml:"decoder,omitempty"`
+}
+
+// Match returns the targets the alert with the given labels is routed to.
+func (r *Route) Match(labels map[string]string) []string {
+	return r.match(labels, nil)
+}
+
+func (r *Route) match(labels map[string]string, inherited []string) []string {
+	if !r.Matchers.Matches(labels) {
+		return nil
+	}
+
+	targets := r.Targets
+	if len(targets) == 0 {
+		targets = inherited
+	}
+
+	var all []string
+	for _, child := range r.Routes {
+		matches := child.match(labels, targets)
+		all = append(all, matches...)
+
+		if matches != nil && !child.Continue {
+			break
+		}
+	}
+
+	// If no child route matched, the alert is handled by the current one.
+	if all == nil {
+		all = append([]string{}, targets...)
+	}
+	return all
+}
+
+func (r *Route) validate(targets map[string]Target, inherited bool) error {
+	for _, name := range r.Targets {
+		if _, ok := targets[name]; !ok {
+			return fmt.Errorf("undefined target %q used in route", name)
+		}
+	}
+	if len(r.Targets) == 0 && !inherited {
+		return errors.New("route has no targets to send to")
+	}
+
+	for _, child := range r.Routes {
+		if child.Auth != nil {
+			return errors.New("auth can only be set on top-level routes")
+		}
+		if child.Decoder != "" {
+			return errors.New("decoder can only be set on top-level routes")
+		}
+		if err := child.validate(targets, inherited || len(r.Targets) > 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"os"
 	"regexp"
 	"sort"
 	"strings"
@@ -11,6 +12,23 @@ import (
 
 const secretToken = "<secret>"
 
+var envRE = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} references in s with the values of the
+// environment variables, an unset variable is an error.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envRE.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRE.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %q is not set", name)
+		}
+		return v
+	})
+	return expanded, err
+}
+
 // Secret is a string that must not be revealed on marshaling.
 type Secret string
 
@@ -23,9 +41,19 @@ func (s Secret) MarshalYAML() (interface{}, error) {
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface for Secret.
+// References to environment variables such as ${VAR} are expanded.
 func (s *Secret) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain Secret
-	return unmarshal((*plain)(s))
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+
+	expanded, err := expandEnv(string(*s))
+	if err != nil {
+		return err
+	}
+	*s = Secret(expanded)
+	return nil
 }
 
 // MarshalJSON implements the json.Marshaler interface for Secret.
@@ -78,6 +106,44 @@ func (u *URL) MarshalJSON() ([]byte, error) {
 	return json.Marshal(u.URL.String())
 }
 
+// ProxyURL is the URL of an HTTP, HTTPS or SOCKS5 proxy, its password is not
+// revealed on marshaling.
+type ProxyURL struct {
+	url.URL
+}
+
+// MarshalYAML implements the yaml.Marshaler interface for ProxyURL.
+func (u *ProxyURL) MarshalYAML() (interface{}, error) {
+	return u.URL.Redacted(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for ProxyURL.
+func (u *ProxyURL) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	urlp, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	switch urlp.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported scheme %q for proxy URL", urlp.Scheme)
+	}
+	if urlp.Host == "" {
+		return fmt.Errorf("missing host for proxy URL")
+	}
+	u.URL = *urlp
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface for ProxyURL.
+func (u *ProxyURL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.URL.Redacted())
+}
+
 // SecretURL is a URL that must not be revealed on marshaling.
 type SecretURL URL
 
@@ -128,13 +194,23 @@ func (s SecretURL) MarshalYAML() (interface{}, error) {
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface for SecretURL.
+// References to environment variables such as ${VAR} are expanded.
 func (s *SecretURL) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var str string
 	if err := unmarshal(&str); err != nil {
 		return err
 	}
 
-	return unmarshal((*URL)(s))
+	expanded, err := expandEnv(str)
+	if err != nil {
+		return err
+	}
+	urlp, err := ParseURL(expanded)
+	if err != nil {
+		return err
+	}
+	s.URL = urlp.URL
+	return nil
 }
 
 // MarshalJSON implements the json.Marshaler interface for SecretURL.
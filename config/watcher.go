@@ -0,0 +1,232 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// DefaultWatchDebounce is the quiet period to wait for after a file change
+// before reloading, so that bursts of events trigger a single reload.
+const DefaultWatchDebounce = time.Second
+
+// Watcher reloads the configuration whenever the configuration file, one of
+// the template files or one of the files referred to by targets changes.
+//
+// Directories are watched rather than files, so that atomic replacements such
+// as the symlink swaps of Kubernetes ConfigMap volumes are noticed. A reload is
+// only triggered when the content of the watched files actually changed.
+type Watcher struct {
+	coordinator *Coordinator
+	debounce    time.Duration
+	logger      log.Logger
+
+	// Protects templates and targetFiles
+	mtx         sync.Mutex
+	templates   []string
+	targetFiles []string
+	updated     chan struct{}
+}
+
+// NewWatcher returns a new Watcher for the configuration of the coordinator.
+// It must be created before the first reload to pick up the template files.
+func NewWatcher(c *Coordinator, debounce time.Duration, l log.Logger) *Watcher {
+	w := &Watcher{
+		coordinator: c,
+		debounce:    debounce,
+		logger:      l,
+		updated:     make(chan struct{}, 1),
+	}
+
+	c.Subscribe(func(conf *Config) error {
+		var targetFiles []string
+		for _, target := range conf.Targets {
+			targetFiles = append(targetFiles, target.files()...)
+		}
+
+		w.mtx.Lock()
+		w.templates = conf.TemplatePaths()
+		w.targetFiles = targetFiles
+		w.mtx.Unlock()
+
+		select {
+		case w.updated <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	return w
+}
+
+// files returns the configuration file, the files referred to by targets and
+// the template files currently matched by the template globs.
+func (w *Watcher) files() []string {
+	w.mtx.Lock()
+	templates := w.templates
+	targetFiles := w.targetFiles
+	w.mtx.Unlock()
+
+	files := append([]string{w.coordinator.configFilePath}, targetFiles...)
+	for _, tp := range templates {
+		matches, err := filepath.Glob(tp)
+		if err != nil {
+			continue
+		}
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// dirs returns the directories to watch.
+func (w *Watcher) dirs() map[string]struct{} {
+	dirs := map[string]struct{}{
+		filepath.Dir(w.coordinator.configFilePath): {},
+	}
+
+	w.mtx.Lock()
+	templates := w.templates
+	w.mtx.Unlock()
+
+	// Glob patterns may match files which do not exist yet, so watch their
+	// directory as well, unless it is a pattern itself.
+	for _, tp := range templates {
+		if dir := filepath.Dir(tp); !hasMeta(dir) {
+			dirs[dir] = struct{}{}
+		}
+	}
+	for _, f := range w.files() {
+		dirs[filepath.Dir(f)] = struct{}{}
+	}
+	return dirs
+}
+
+// fingerprint returns a digest over the names and contents of the watched
+// files.
+func (w *Watcher) fingerprint() string {
+	files := w.files()
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, name := range files {
+		io.WriteString(h, name)
+		f, err := os.Open(name)
+		if err != nil {
+			io.WriteString(h, err.Error())
+			continue
+		}
+		io.Copy(h, f)
+		f.Close()
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Run watches the files until the context is canceled.
+func (w *Watcher) Run(ctx context.Context) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+
+	watched := map[string]struct{}{}
+	updateWatches := func() {
+		dirs := w.dirs()
+		for dir := range watched {
+			if _, ok := dirs[dir]; !ok {
+				fsw.Remove(dir)
+				delete(watched, dir)
+			}
+		}
+		for dir := range dirs {
+			if _, ok := watched[dir]; ok {
+				continue
+			}
+			if err := fsw.Add(dir); err != nil {
+				level.Warn(w.logger).Log("msg", "Failed to watch directory", "dir", dir, "err", err)
+				continue
+			}
+			watched[dir] = struct{}{}
+		}
+	}
+	updateWatches()
+
+	var (
+		last   = w.fingerprint()
+		timer  *time.Timer
+		timerC <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.updated:
+			updateWatches()
+			last = w.fingerprint()
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			level.Debug(w.logger).Log("msg", "File change detected", "event", event)
+			if timer == nil {
+				timer = time.NewTimer(w.debounce)
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(w.debounce)
+			}
+			timerC = timer.C
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			level.Warn(w.logger).Log("msg", "Error watching files", "err", err)
+		case <-timerC:
+			timerC = nil
+			fingerprint := w.fingerprint()
+			if fingerprint == last {
+				continue
+			}
+			// Remember the content even if the reload fails, it is retried on
+			// the next change only.
+			last = fingerprint
+
+			level.Info(w.logger).Log("msg", "Configuration change detected, reloading")
+			if err := w.coordinator.Reload(); err != nil {
+				level.Warn(w.logger).Log("msg", "Reloading changed configuration failed, keeping the previous one", "err", err)
+			}
+			updateWatches()
+		}
+	}
+}
+
+// hasMeta reports whether path contains any of the magic characters
+// recognized by filepath.Match.
+func hasMeta(path string) bool {
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package notifier
+
+import (
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// WithBanner returns a copy of the notification with the banner prepended to
+// its text, such as to tell that it is delivered to a fallback target. Feed
+// cards have no text, the banner is added as their first link instead.
+func WithBanner(n *models.DingTalkNotification, banner string) *models.DingTalkNotification {
+	c := *n
+	switch {
+	case n.Markdown != nil:
+		markdown := *n.Markdown
+		markdown.Text = "**" + banner + "**\n\n" + markdown.Text
+		c.Markdown = &markdown
+	case n.ActionCard != nil:
+		actionCard := *n.ActionCard
+		actionCard.Text = "**" + banner + "**\n\n" + actionCard.Text
+		c.ActionCard = &actionCard
+	case n.Link != nil:
+		link := *n.Link
+		link.Text = banner + "\n" + link.Text
+		c.Link = &link
+	case n.FeedCard != nil && len(n.FeedCard.Links) > 0:
+		links := make([]models.DingTalkNotificationFeedCardLink, 0, len(n.FeedCard.Links)+1)
+		links = append(links, models.DingTalkNotificationFeedCardLink{
+			Title:      banner,
+			MessageURL: n.FeedCard.Links[0].MessageURL,
+		})
+		c.FeedCard = &models.DingTalkNotificationFeedCard{Links: append(links, n.FeedCard.Links...)}
+	case n.Text != nil:
+		text := *n.Text
+		text.Content = banner + "\n\n" + text.Content
+		c.Text = &text
+	}
+	return &c
+}
@@ -0,0 +1,131 @@
+package notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+const coalesceSeparator = "\n\n---\n\n"
+
+// coalesceTitleReserve is the number of bytes reserved for the "(+n more)"
+// suffix of merged titles.
+const coalesceTitleReserve = 24
+
+// Coalesce merges consecutive notifications of the same mergeable message type
+// (markdown and text) into as few notifications as fit within the size limit.
+// Notifications of other types are returned unchanged.
+func Coalesce(notifications []*models.DingTalkNotification, sizeLimit config.SizeLimitConfig) []*models.DingTalkNotification {
+	var (
+		result []*models.DingTalkNotification
+		group  []*models.DingTalkNotification
+		size   int
+	)
+	flush := func() {
+		if len(group) > 0 {
+			result = append(result, mergeNotifications(group))
+			group = nil
+		}
+	}
+
+	for _, n := range notifications {
+		mergeable := n.MessageType == models.MessageTypeMarkdown || n.MessageType == models.MessageTypeText
+		if !mergeable {
+			flush()
+			result = append(result, n)
+			continue
+		}
+		if len(group) > 0 && group[0].MessageType != n.MessageType {
+			flush()
+		}
+		if len(group) > 0 {
+			size += mergedSize(n)
+			if size > sizeLimit.MaxBytes {
+				flush()
+			}
+		}
+		if len(group) == 0 {
+			size = payloadSize(n) + coalesceTitleReserve
+		}
+		group = append(group, n)
+	}
+	flush()
+
+	return result
+}
+
+// payloadSize returns the size of the notification once encoded.
+func payloadSize(n *models.DingTalkNotification) int {
+	b, _ := json.Marshal(n)
+	return len(b)
+}
+
+// mergedSize returns an upper bound of the bytes the notification adds to the
+// payload of those it is merged into: its text, the separator and its
+// mentions.
+func mergedSize(n *models.DingTalkNotification) int {
+	var text string
+	switch n.MessageType {
+	case models.MessageTypeMarkdown:
+		text = n.Markdown.Text
+	case models.MessageTypeText:
+		text = n.Text.Content
+	}
+	b, _ := json.Marshal(coalesceSeparator + text)
+	size := len(b) - len(`""`)
+	if n.At != nil {
+		b, _ := json.Marshal(n.At)
+		size += len(b)
+	}
+	return size
+}
+
+func mergeNotifications(group []*models.DingTalkNotification) *models.DingTalkNotification {
+	if len(group) == 1 {
+		return group[0]
+	}
+
+	merged := &models.DingTalkNotification{MessageType: group[0].MessageType}
+	texts := make([]string, 0, len(group))
+	for _, n := range group {
+		switch n.MessageType {
+		case models.MessageTypeMarkdown:
+			texts = append(texts, n.Markdown.Text)
+		case models.MessageTypeText:
+			texts = append(texts, n.Text.Content)
+		}
+		merged.At = mergeAt(merged.At, n.At)
+	}
+
+	text := strings.Join(texts, coalesceSeparator)
+	switch merged.MessageType {
+	case models.MessageTypeMarkdown:
+		merged.Markdown = &models.DingTalkNotificationMarkdown{
+			Title: fmt.Sprintf("%s (+%d more)", group[0].Markdown.Title, len(group)-1),
+			Text:  text,
+		}
+	case models.MessageTypeText:
+		merged.Text = &models.DingTalkNotificationText{
+			Title:   group[0].Text.Title,
+			Content: text,
+		}
+	}
+	return merged
+}
+
+func mergeAt(a, b *models.DingTalkNotificationAt) *models.DingTalkNotificationAt {
+	if b == nil {
+		return a
+	}
+	if a == nil {
+		a = &models.DingTalkNotificationAt{}
+	}
+
+	a.IsAtAll = a.IsAtAll || b.IsAtAll
+	a.AtMobiles = appendUnique(a.AtMobiles, b.AtMobiles...)
+	a.AtUserIds = appendUnique(a.AtUserIds, b.AtUserIds...)
+	return a
+}
@@ -0,0 +1,108 @@
+package notifier
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// mentions is the set of people to mention in a notification.
+type mentions struct {
+	all     bool
+	mobiles []string
+	userIDs []string
+}
+
+// at returns the mention part of a notification.
+func (m *mentions) at() *models.DingTalkNotificationAt {
+	return &models.DingTalkNotificationAt{
+		IsAtAll:   m.all,
+		AtMobiles: m.mobiles,
+		AtUserIds: m.userIDs,
+	}
+}
+
+// resolveMentions returns the people to mention for the given group: the
+// static ones, the ones rendered from the templates, the ones found in the
+// directory for the configured labels of its alerts and the ones of the
+// matching rules. The templates are rendered with data.
+func (r *DingNotificationBuilder) resolveMentions(data interface{}, group *models.Data) (*mentions, error) {
+	mention := r.target.Mention
+	if mention == nil {
+		return nil, nil
+	}
+
+	res := &mentions{all: mention.All}
+	res.mobiles = appendUnique(res.mobiles, mention.Mobiles...)
+	res.userIDs = appendUnique(res.userIDs, mention.UserIDs...)
+
+	if mention.MobilesTemplate != "" {
+		s, err := r.tmpl.ExecuteTextString(mention.MobilesTemplate, data)
+		if err != nil {
+			return nil, err
+		}
+		res.mobiles = appendUnique(res.mobiles, splitList(s)...)
+	}
+	if mention.UserIDsTemplate != "" {
+		s, err := r.tmpl.ExecuteTextString(mention.UserIDsTemplate, data)
+		if err != nil {
+			return nil, err
+		}
+		res.userIDs = appendUnique(res.userIDs, splitList(s)...)
+	}
+
+	for _, name := range mention.Labels {
+		for _, alert := range group.Alerts {
+			if entry, ok := r.directory[alert.Labels[name]]; ok {
+				res.mobiles = appendUnique(res.mobiles, entry.Mobiles...)
+				res.userIDs = appendUnique(res.userIDs, entry.UserIDs...)
+			}
+		}
+	}
+
+	for _, rule := range mention.Rules {
+		for _, alert := range group.Alerts {
+			if rule.Status != "" && rule.Status != alert.Status {
+				continue
+			}
+			if !rule.Matchers.Matches(alert.Labels) {
+				continue
+			}
+
+			res.all = res.all || rule.All
+			res.mobiles = appendUnique(res.mobiles, rule.Mobiles...)
+			res.userIDs = appendUnique(res.userIDs, rule.UserIDs...)
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// splitList splits a rendered list separated by commas or whitespaces.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool {
+		return c == ',' || unicode.IsSpace(c)
+	})
+}
+
+// appendUnique appends the non-empty values of vs not found in list.
+func appendUnique(list []string, vs ...string) []string {
+	for _, v := range vs {
+		if v == "" {
+			continue
+		}
+		found := false
+		for _, e := range list {
+			if e == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
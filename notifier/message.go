@@ -0,0 +1,85 @@
+package notifier
+
+import (
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// buildMessage builds a notification of the configured message type from the
+// rendered title and text, rendering the type specific fields with data.
+func (r *DingNotificationBuilder) buildMessage(data interface{}, part renderedPart) (*models.DingTalkNotification, error) {
+	var (
+		msg          = &r.message
+		notification = &models.DingTalkNotification{MessageType: msg.GetType()}
+		err          error
+	)
+
+	// render renders the template into dst, keeping the first error.
+	render := func(dst *string, text string) {
+		if err != nil {
+			return
+		}
+		*dst, err = r.tmpl.ExecuteTextString(text, data)
+	}
+
+	switch notification.MessageType {
+	case models.MessageTypeText:
+		notification.Text = &models.DingTalkNotificationText{
+			Title:   part.title,
+			Content: part.text,
+		}
+
+	case models.MessageTypeLink:
+		link := &models.DingTalkNotificationLink{
+			Title: part.title,
+			Text:  part.text,
+		}
+		render(&link.MessageURL, msg.MessageURL)
+		render(&link.PictureURL, msg.PictureURL)
+		notification.Link = link
+
+	case models.MessageTypeActionCard:
+		card := &models.DingTalkNotificationActionCard{
+			Title:             part.title,
+			Text:              part.text,
+			HideAvatar:        "0",
+			ButtonOrientation: "0",
+		}
+		if msg.HideAvatar {
+			card.HideAvatar = "1"
+		}
+		if msg.ButtonOrientation == "horizontal" {
+			card.ButtonOrientation = "1"
+		}
+		render(&card.SingleTitle, msg.SingleTitle)
+		render(&card.SingleURL, msg.SingleURL)
+		for _, b := range msg.Buttons {
+			var button models.DingTalkNotificationButton
+			render(&button.Title, b.Title)
+			render(&button.ActionURL, b.URL)
+			card.Buttons = append(card.Buttons, button)
+		}
+		notification.ActionCard = card
+
+	case models.MessageTypeFeedCard:
+		feedCard := &models.DingTalkNotificationFeedCard{}
+		for _, l := range msg.Links {
+			var link models.DingTalkNotificationFeedCardLink
+			render(&link.Title, l.Title)
+			render(&link.MessageURL, l.MessageURL)
+			render(&link.PictureURL, l.PictureURL)
+			feedCard.Links = append(feedCard.Links, link)
+		}
+		notification.FeedCard = feedCard
+
+	default:
+		notification.Markdown = &models.DingTalkNotificationMarkdown{
+			Title: part.title,
+			Text:  part.text,
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return notification, nil
+}
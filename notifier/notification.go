@@ -2,6 +2,7 @@ package notifier
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -18,77 +19,131 @@ import (
 )
 
 type DingNotificationBuilder struct {
-	tmpl     *template.Template
-	target   *config.Target
-	titleTpl string
-	textTpl  string
+	tmpl      *template.Template
+	target    *config.Target
+	message   config.TargetMessage
+	sizeLimit config.SizeLimitConfig
+	directory map[string]config.DirectoryEntry
 }
 
 func NewDingNotificationBuilder(tmpl *template.Template, conf *config.Config, target *config.Target) *DingNotificationBuilder {
 	// Message template from the following order:
 	//   target level > config global level > builtin global level
-
-	var (
-		defaultMessage = conf.GetDefaultMessage()
-		titleTpl       = defaultMessage.Title
-		textTpl        = defaultMessage.Text
-	)
-
+	message := conf.GetDefaultMessage()
 	if target.Message != nil {
-		titleTpl = target.Message.Title
-		textTpl = target.Message.Text
+		message = *target.Message
 	}
 
 	return &DingNotificationBuilder{
-		tmpl:     tmpl,
-		target:   target,
-		titleTpl: titleTpl,
-		textTpl:  textTpl,
+		tmpl:      tmpl,
+		target:    target,
+		message:   message,
+		sizeLimit: conf.GetSizeLimitConfig(target),
+		directory: conf.Directory,
 	}
 }
 
 func (r *DingNotificationBuilder) renderTitle(data interface{}) (string, error) {
-	return r.tmpl.ExecuteTextString(r.titleTpl, data)
+	return r.tmpl.ExecuteTextString(r.message.Title, data)
 }
 
 func (r *DingNotificationBuilder) renderText(data interface{}) (string, error) {
-	return r.tmpl.ExecuteTextString(r.textTpl, data)
+	return r.tmpl.ExecuteTextString(r.message.Text, data)
 }
 
-func (r *DingNotificationBuilder) Build(m *models.WebhookMessage) (*models.DingTalkNotification, error) {
-	if r.target.Mention != nil {
-		m.AtMobiles = append(m.AtMobiles, r.target.Mention.Mobiles...)
+// Build renders the webhook message into one or more notifications. More than
+// one notification is returned when the rendered message exceeds the size
+// limit and is split, they must be sent in order. Rendering is aborted with the
+// error of ctx once it is done.
+func (r *DingNotificationBuilder) Build(ctx context.Context, m *models.WebhookMessage) ([]*models.DingTalkNotification, error) {
+	if r.target.PerAlert {
+		return r.buildPerAlert(ctx, m)
 	}
 
-	title, err := r.renderTitle(m)
+	mentioned, err := r.resolveMentions(m, (*models.Data)(m))
 	if err != nil {
 		return nil, err
 	}
-	content, err := r.renderText(m)
-	if err != nil {
-		return nil, err
+	if mentioned != nil {
+		m.AtMobiles = appendUnique(m.AtMobiles, mentioned.mobiles...)
+		m.AtUserIds = appendUnique(m.AtUserIds, mentioned.userIDs...)
 	}
 
-	notification := &models.DingTalkNotification{
-		MessageType: "markdown",
-		Markdown: &models.DingTalkNotificationMarkdown{
-			Title: title,
-			Text:  content,
-		},
+	var parts []renderedPart
+	if r.message.GetType() == models.MessageTypeFeedCard {
+		// Feed cards consist of links only, there is no text to split.
+		parts = []renderedPart{{}}
+	} else {
+		budget, err := r.payloadBudget(m, mentioned)
+		if err != nil {
+			return nil, err
+		}
+		parts, err = r.renderParts(ctx, m, budget)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Build mention
-	if r.target.Mention != nil {
-		notification.At = &models.DingTalkNotificationAt{
-			IsAtAll:   r.target.Mention.All,
-			AtMobiles: r.target.Mention.Mobiles,
+	return r.buildNotifications(m, parts, mentioned)
+}
+
+// buildPerAlert renders every alert of the message on its own.
+func (r *DingNotificationBuilder) buildPerAlert(ctx context.Context, m *models.WebhookMessage) ([]*models.DingTalkNotification, error) {
+	var notifications []*models.DingTalkNotification
+	for _, alert := range m.Alerts {
+		data := models.NewAlertData((*models.Data)(m), alert)
+
+		mentioned, err := r.resolveMentions(data, &data.Data)
+		if err != nil {
+			return nil, err
+		}
+		if mentioned != nil {
+			data.AtMobiles = appendUnique(data.AtMobiles, mentioned.mobiles...)
+			data.AtUserIds = appendUnique(data.AtUserIds, mentioned.userIDs...)
 		}
+
+		part := renderedPart{}
+		if r.message.GetType() != models.MessageTypeFeedCard {
+			budget, err := r.payloadBudget(data, mentioned)
+			if err != nil {
+				return nil, err
+			}
+			part, err = r.render(ctx, data)
+			if err != nil {
+				return nil, err
+			}
+			part = truncatePart(part, budget)
+		}
+
+		ns, err := r.buildNotifications(data, []renderedPart{part}, mentioned)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, ns...)
+	}
+	return notifications, nil
+}
+
+func (r *DingNotificationBuilder) buildNotifications(data interface{}, parts []renderedPart, mentioned *mentions) ([]*models.DingTalkNotification, error) {
+	notifications := make([]*models.DingTalkNotification, 0, len(parts))
+	for _, part := range parts {
+		notification, err := r.buildMessage(data, part)
+		if err != nil {
+			return nil, err
+		}
+
+		// Build mention
+		if mentioned != nil {
+			notification.At = mentioned.at()
+		}
+
+		notifications = append(notifications, notification)
 	}
 
-	return notification, nil
+	return notifications, nil
 }
 
-func SendNotification(notification *models.DingTalkNotification, httpClient *http.Client, target *config.Target) (*models.DingTalkNotificationResponse, error) {
+func SendNotification(ctx context.Context, notification *models.DingTalkNotification, httpClient *http.Client, target *config.Target) (*models.DingTalkNotificationResponse, error) {
 	targetURL := *target.URL
 	// Calculate signature when secret is provided
 	if target.Secret != "" {
@@ -110,7 +165,7 @@ func SendNotification(notification *models.DingTalkNotification, httpClient *htt
 		return nil, fmt.Errorf("error encoding DingTalk request: %w", err)
 	}
 
-	httpReq, err := http.NewRequest("POST", targetURL.String(), bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", targetURL.String(), bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("error building DingTalk request: %w", err)
 	}
@@ -126,7 +181,7 @@ func SendNotification(notification *models.DingTalkNotification, httpClient *htt
 	}()
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("unacceptable response code %d", resp.StatusCode)
+		return nil, &StatusCodeError{StatusCode: resp.StatusCode}
 	}
 
 	var robotResp models.DingTalkNotificationResponse
@@ -137,3 +192,12 @@ func SendNotification(notification *models.DingTalkNotification, httpClient *htt
 
 	return &robotResp, nil
 }
+
+// StatusCodeError is returned when DingTalk replies with a non-200 HTTP status.
+type StatusCodeError struct {
+	StatusCode int
+}
+
+func (e *StatusCodeError) Error() string {
+	return fmt.Sprintf("unacceptable response code %d", e.StatusCode)
+}
@@ -0,0 +1,118 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// DingTalk robot error codes which indicate that the message was throttled.
+const (
+	ErrCodeSendTooFast     = 130101
+	ErrCodeSendTooFastHour = 130102
+)
+
+// DingTalk robot error codes which indicate that the robot cannot be used at
+// all, whatever the message.
+const (
+	ErrCodeTokenInvalid  = 300001
+	ErrCodeTokenNotExist = 300005
+	ErrCodeRobotNotExist = 400101
+	ErrCodeRobotStopped  = 400102
+)
+
+// IsRobotError tells whether the error code indicates that the robot cannot
+// be used at all, rather than that the message was refused.
+func IsRobotError(code int) bool {
+	switch code {
+	case ErrCodeTokenInvalid, ErrCodeTokenNotExist, ErrCodeRobotNotExist, ErrCodeRobotStopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendNotificationWithRetry sends the notification, retrying on network errors,
+// 5xx responses and DingTalk throttling with exponential backoff and jitter.
+// It gives up early when ctx is done, and returns the number of attempts made.
+func SendNotificationWithRetry(ctx context.Context, logger log.Logger, notification *models.DingTalkNotification, httpClient *http.Client, target *config.Target, retry config.RetryConfig) (*models.DingTalkNotificationResponse, int, error) {
+	var (
+		robotResp *models.DingTalkNotificationResponse
+		err       error
+	)
+	for attempt := 1; ; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err == nil {
+				err = ctxErr
+			}
+			return robotResp, attempt - 1, err
+		}
+
+		robotResp, err = SendNotification(ctx, notification, httpClient, target)
+		if !shouldRetry(robotResp, err) || attempt >= retry.MaxAttempts {
+			return robotResp, attempt, err
+		}
+
+		backoff := backoffDuration(retry, attempt)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Failed to send notification, retrying", "attempt", attempt, "backoff", backoff, "err", err)
+		} else {
+			level.Warn(logger).Log("msg", "Notification throttled by DingTalk, retrying", "attempt", attempt, "backoff", backoff, "respCode", robotResp.ErrorCode, "respMsg", robotResp.ErrorMessage)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func shouldRetry(robotResp *models.DingTalkNotificationResponse, err error) bool {
+	if err != nil {
+		var (
+			urlErr    *url.Error
+			statusErr *StatusCodeError
+		)
+		switch {
+		case errors.As(err, &urlErr):
+			return true
+		case errors.As(err, &statusErr):
+			return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+		default:
+			return false
+		}
+	}
+
+	switch robotResp.ErrorCode {
+	case ErrCodeSendTooFast, ErrCodeSendTooFastHour:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoffDuration returns the exponential backoff for the given attempt (starting
+// from 1) with equal jitter applied.
+func backoffDuration(retry config.RetryConfig, attempt int) time.Duration {
+	d := retry.InitialBackoff
+	for i := 1; i < attempt && d < retry.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > retry.MaxBackoff {
+		d = retry.MaxBackoff
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,62 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+	"github.com/timonwong/prometheus-webhook-dingtalk/template"
+)
+
+// TestResult is the outcome of sending one synthetic notification.
+type TestResult struct {
+	Status       string `json:"status"`
+	MessageType  string `json:"msgtype"`
+	ErrorCode    int    `json:"errcode"`
+	ErrorMessage string `json:"errmsg"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Success reports whether DingTalk accepted the notification.
+func (r *TestResult) Success() bool {
+	return r.Error == "" && r.ErrorCode == 0
+}
+
+// SendTestNotifications fires a synthetic alert at the target, first firing
+// and then resolved, going through the target's real builder and signer.
+// Every notification is attempted once and the DingTalk responses are
+// reported as they are. An error is returned only when rendering fails.
+func SendTestNotifications(ctx context.Context, logger log.Logger, tmpl *template.Template, conf *config.Config, target *config.Target, httpClient *http.Client) ([]TestResult, error) {
+	builder := NewDingNotificationBuilder(tmpl, conf, target)
+
+	now := time.Now()
+	var results []TestResult
+	for _, status := range []model.AlertStatus{model.AlertFiring, model.AlertResolved} {
+		notifications, err := builder.Build(ctx, models.NewSampleWebhookMessage(string(status), now))
+		if err != nil {
+			return results, fmt.Errorf("failed to render %s notification: %w", status, err)
+		}
+
+		for _, notification := range notifications {
+			result := TestResult{
+				Status:      string(status),
+				MessageType: notification.MessageType,
+			}
+			robotResp, _, err := SendNotificationWithRetry(ctx, logger, notification, httpClient, target, config.RetryConfig{MaxAttempts: 1})
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.ErrorCode = robotResp.ErrorCode
+				result.ErrorMessage = robotResp.ErrorMessage
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,235 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// renderedPart is the rendered title and text of one message.
+type renderedPart struct {
+	title string
+	text  string
+}
+
+func (r *DingNotificationBuilder) render(ctx context.Context, data interface{}) (renderedPart, error) {
+	// Rendering may happen many times when splitting, give up as soon as
+	// the caller is gone.
+	if err := ctx.Err(); err != nil {
+		return renderedPart{}, err
+	}
+	title, err := r.renderTitle(data)
+	if err != nil {
+		return renderedPart{}, err
+	}
+	text, err := r.renderText(data)
+	if err != nil {
+		return renderedPart{}, err
+	}
+	return renderedPart{title: title, text: text}, nil
+}
+
+// renderWithAlerts renders the message as if it only contained the given alerts.
+func (r *DingNotificationBuilder) renderWithAlerts(ctx context.Context, m *models.WebhookMessage, alerts models.Alerts) (renderedPart, error) {
+	sub := *m
+	sub.Alerts = alerts
+	return r.render(ctx, &sub)
+}
+
+// renderParts renders the message, applying the size limit strategy if the
+// rendered title and text exceed the budget.
+func (r *DingNotificationBuilder) renderParts(ctx context.Context, m *models.WebhookMessage, budget int) ([]renderedPart, error) {
+	part, err := r.render(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if partSize(part) <= budget {
+		return []renderedPart{part}, nil
+	}
+
+	if r.sizeLimit.Strategy == config.SizeLimitStrategyTruncate {
+		part, err := r.renderTruncated(ctx, m, budget)
+		if err != nil {
+			return nil, err
+		}
+		return []renderedPart{part}, nil
+	}
+	return r.renderSplit(ctx, m, budget)
+}
+
+// payloadBudget returns the number of bytes left within the size limit for
+// the encoded title and text of a notification, once the rest of its payload,
+// as rendered for data, is accounted for.
+func (r *DingNotificationBuilder) payloadBudget(data interface{}, mentioned *mentions) (int, error) {
+	notification, err := r.buildMessage(data, renderedPart{})
+	if err != nil {
+		return 0, err
+	}
+	if mentioned != nil {
+		notification.At = mentioned.at()
+	}
+	b, err := json.Marshal(notification)
+	if err != nil {
+		return 0, err
+	}
+	// The empty title and text are encoded as two pairs of quotes.
+	return r.sizeLimit.MaxBytes - (len(b) - 2*len(`""`)), nil
+}
+
+// partSize returns the size of the title and text of the part once encoded
+// in the payload.
+func partSize(part renderedPart) int {
+	return jsonSize(part.title) + jsonSize(part.text)
+}
+
+func jsonSize(s string) int {
+	b, _ := json.Marshal(s)
+	return len(b)
+}
+
+// truncatePart cuts the text of the part until the part fits within the
+// budget, or the text is gone.
+func truncatePart(part renderedPart, budget int) renderedPart {
+	for excess := partSize(part) - budget; excess > 0 && part.text != ""; excess = partSize(part) - budget {
+		n := len(part.text) - excess
+		if n < 0 {
+			n = 0
+		}
+		part.text = truncateString(part.text, n)
+	}
+	return part
+}
+
+// splitFooterReserve is the number of bytes reserved for the "(i/n)" footer.
+const splitFooterReserve = 32
+
+// renderSplit splits the alerts of the message into consecutive chunks, each
+// of them rendering within the budget, and numbers the resulting parts.
+func (r *DingNotificationBuilder) renderSplit(ctx context.Context, m *models.WebhookMessage, budget int) ([]renderedPart, error) {
+	var parts []renderedPart
+	for start := 0; start < len(m.Alerts); {
+		part, n, err := r.renderChunk(ctx, m, m.Alerts[start:], budget-splitFooterReserve)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+		start += n
+	}
+
+	if len(parts) == 0 {
+		// No alerts to split on.
+		part, err := r.render(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		return []renderedPart{truncatePart(part, budget)}, nil
+	}
+
+	if len(parts) > 1 {
+		for i := range parts {
+			n := fmt.Sprintf("(%d/%d)", i+1, len(parts))
+			parts[i].title = parts[i].title + " " + n
+			parts[i].text = parts[i].text + "\n\n" + n
+		}
+	}
+	return parts, nil
+}
+
+// renderChunk renders as many of the first alerts as fit within the budget,
+// and returns how many it rendered. The first alert is cut if it does not fit
+// on its own. The number of alerts is doubled then bisected, so that a chunk
+// of n alerts takes O(log n) renderings.
+func (r *DingNotificationBuilder) renderChunk(ctx context.Context, m *models.WebhookMessage, alerts models.Alerts, budget int) (renderedPart, int, error) {
+	fits := func(n int) (renderedPart, bool, error) {
+		part, err := r.renderWithAlerts(ctx, m, alerts[:n])
+		return part, partSize(part) <= budget, err
+	}
+
+	best, ok, err := fits(1)
+	if err != nil {
+		return renderedPart{}, 0, err
+	}
+	if !ok {
+		return truncatePart(best, budget), 1, nil
+	}
+
+	// The first lo alerts fit, the first hi ones do not.
+	lo, hi := 1, len(alerts)+1
+	for n := 2; n < hi; n *= 2 {
+		part, ok, err := fits(n)
+		if err != nil {
+			return renderedPart{}, 0, err
+		}
+		if !ok {
+			hi = n
+			break
+		}
+		best, lo = part, n
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		part, ok, err := fits(mid)
+		if err != nil {
+			return renderedPart{}, 0, err
+		}
+		if ok {
+			best, lo = part, mid
+		} else {
+			hi = mid
+		}
+	}
+	return best, lo, nil
+}
+
+// renderTruncated renders as many alerts as fit within the budget and appends
+// a footer telling how many alerts were left out.
+func (r *DingNotificationBuilder) renderTruncated(ctx context.Context, m *models.WebhookMessage, budget int) (renderedPart, error) {
+	footer := func(omitted int) string {
+		return fmt.Sprintf("\n\n**%d more alerts not shown**", omitted)
+	}
+
+	// Binary search for the largest number of alerts which fit.
+	var (
+		best   renderedPart
+		found  bool
+		lo, hi = 1, len(m.Alerts) - 1
+	)
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		part, err := r.renderWithAlerts(ctx, m, m.Alerts[:mid])
+		if err != nil {
+			return renderedPart{}, err
+		}
+		part.text += footer(len(m.Alerts) - mid)
+		if partSize(part) <= budget {
+			best, found = part, true
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	if found {
+		return best, nil
+	}
+
+	part, err := r.render(ctx, m)
+	if err != nil {
+		return renderedPart{}, err
+	}
+	return truncatePart(part, budget), nil
+}
+
+// truncateString cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
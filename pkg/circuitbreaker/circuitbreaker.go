@@ -0,0 +1,178 @@
+// Package circuitbreaker implements a circuit breaker which keeps track of the
+// health of what it protects.
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit.
+type State int
+
+const (
+	// StateClosed lets everything through.
+	StateClosed State = iota
+	// StateOpen lets nothing through until the open timeout elapses.
+	StateOpen
+	// StateHalfOpen lets a single probe through, which closes the circuit on
+	// success or opens it again on failure.
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Status is a snapshot of a breaker.
+type Status struct {
+	State               State
+	ConsecutiveFailures int
+	LastError           string
+	LastErrorTime       time.Time
+	LastSuccessTime     time.Time
+	// RetryTime is when an open circuit lets a probe through.
+	RetryTime time.Time
+}
+
+// Breaker opens after a number of consecutive failures. A zero threshold
+// never opens the circuit, the health is tracked nevertheless.
+type Breaker struct {
+	mtx         sync.Mutex
+	threshold   int
+	openTimeout time.Duration
+
+	state      State
+	openedAt   time.Time
+	probing    bool
+	probedAt   time.Time
+	failures   int
+	lastErr    string
+	lastErrAt  time.Time
+	lastSuccAt time.Time
+}
+
+// New returns a closed breaker.
+func New(threshold int, openTimeout time.Duration) *Breaker {
+	return &Breaker{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+	}
+}
+
+// SetLimits changes the settings of the breaker, closing the circuit if it
+// can no longer open.
+func (b *Breaker) SetLimits(threshold int, openTimeout time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.threshold = threshold
+	b.openTimeout = openTimeout
+	if threshold <= 0 {
+		b.state = StateClosed
+		b.probing = false
+	}
+}
+
+// Allow reports whether a call may go through. Once the open timeout elapsed,
+// a single call is let through as a probe, another one is only let through
+// if the probe did not report back within the open timeout.
+func (b *Breaker) Allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case StateOpen:
+		if now.Sub(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.state = StateHalfOpen
+		b.probing = false
+	case StateHalfOpen:
+	default:
+		return true
+	}
+
+	if b.probing && now.Sub(b.probedAt) < b.openTimeout {
+		return false
+	}
+	b.probing = true
+	b.probedAt = now
+	return true
+}
+
+// Release gives back the probe let through by Allow when the call is not made
+// after all, or its outcome tells nothing about the health of what the
+// breaker protects, so that the next call probes instead.
+func (b *Breaker) Release() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.state == StateHalfOpen {
+		b.probing = false
+	}
+}
+
+// Success records a successful call, it returns true if it closed the circuit.
+func (b *Breaker) Success() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	closed := b.state != StateClosed
+	b.state = StateClosed
+	b.probing = false
+	b.failures = 0
+	b.lastSuccAt = time.Now()
+	return closed
+}
+
+// Failure records a failed call, it returns true if it opened the circuit.
+func (b *Breaker) Failure(reason string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	b.failures++
+	b.lastErr = reason
+	b.lastErrAt = now
+	b.probing = false
+
+	switch {
+	case b.threshold <= 0:
+		return false
+	case b.state == StateClosed && b.failures < b.threshold:
+		return false
+	}
+	opened := b.state != StateOpen
+	b.state = StateOpen
+	b.openedAt = now
+	return opened
+}
+
+// Status returns a snapshot of the breaker.
+func (b *Breaker) Status() Status {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	s := Status{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		LastError:           b.lastErr,
+		LastErrorTime:       b.lastErrAt,
+		LastSuccessTime:     b.lastSuccAt,
+	}
+	if b.state == StateOpen {
+		s.RetryTime = b.openedAt.Add(b.openTimeout)
+	}
+	return s
+}
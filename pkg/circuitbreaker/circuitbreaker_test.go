@@ -0,0 +1,141 @@
+package circuitbreaker
+
+import (
+	"testing"
+	"time"
+)
+
+func assertState(t *testing.T, b *Breaker, want State) {
+	t.Helper()
+	if got := b.Status().State; got != want {
+		t.Fatalf("got state %s, want %s", got, want)
+	}
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := New(3, time.Hour)
+	for i := 0; i < 2; i++ {
+		if b.Failure("boom") {
+			t.Fatalf("circuit opened after %d failures", i+1)
+		}
+	}
+	assertState(t, b, StateClosed)
+
+	// A success resets the count.
+	b.Success()
+	b.Failure("boom")
+	b.Failure("boom")
+	assertState(t, b, StateClosed)
+	if !b.Failure("boom") {
+		t.Fatal("expected the third consecutive failure to open the circuit")
+	}
+	assertState(t, b, StateOpen)
+	if b.Allow() {
+		t.Fatal("expected an open circuit not to let calls through")
+	}
+
+	s := b.Status()
+	if s.ConsecutiveFailures != 3 || s.LastError != "boom" || s.RetryTime.IsZero() {
+		t.Fatalf("unexpected status %+v", s)
+	}
+}
+
+func TestBreakerZeroThresholdNeverOpens(t *testing.T) {
+	b := New(0, time.Hour)
+	for i := 0; i < 10; i++ {
+		if b.Failure("boom") {
+			t.Fatal("expected the circuit never to open")
+		}
+	}
+	if !b.Allow() {
+		t.Fatal("expected calls to go through")
+	}
+	if s := b.Status(); s.ConsecutiveFailures != 10 {
+		t.Fatalf("got %d consecutive failures, want 10", s.ConsecutiveFailures)
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	b := New(1, 10*time.Millisecond)
+	b.Failure("boom")
+	time.Sleep(20 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatal("expected a probe to be let through once the open timeout elapsed")
+	}
+	assertState(t, b, StateHalfOpen)
+	if b.Allow() {
+		t.Fatal("expected a single probe at a time")
+	}
+
+	if !b.Success() {
+		t.Fatal("expected a successful probe to close the circuit")
+	}
+	assertState(t, b, StateClosed)
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("expected a closed circuit to let calls through")
+	}
+}
+
+func TestBreakerFailedProbeReopens(t *testing.T) {
+	b := New(1, 10*time.Millisecond)
+	b.Failure("boom")
+	time.Sleep(20 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatal("expected a probe to be let through")
+	}
+	if !b.Failure("still down") {
+		t.Fatal("expected a failed probe to open the circuit again")
+	}
+	assertState(t, b, StateOpen)
+	if b.Allow() {
+		t.Fatal("expected the open timeout to start over")
+	}
+}
+
+func TestBreakerReleaseProbe(t *testing.T) {
+	b := New(1, 10*time.Millisecond)
+	b.Failure("boom")
+	time.Sleep(20 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatal("expected a probe to be let through")
+	}
+	// The probe is not sent after all, the next call probes instead.
+	b.Release()
+	assertState(t, b, StateHalfOpen)
+	if !b.Allow() {
+		t.Fatal("expected the released probe to be let through again")
+	}
+	if b.Allow() {
+		t.Fatal("expected a single probe at a time")
+	}
+}
+
+func TestBreakerStuckProbeExpires(t *testing.T) {
+	b := New(1, 10*time.Millisecond)
+	b.Failure("boom")
+	time.Sleep(20 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatal("expected a probe to be let through")
+	}
+	// The probe never reports back.
+	time.Sleep(20 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("expected another probe once the first one timed out")
+	}
+}
+
+func TestBreakerSetLimits(t *testing.T) {
+	b := New(1, time.Hour)
+	b.Failure("boom")
+	assertState(t, b, StateOpen)
+
+	b.SetLimits(0, time.Hour)
+	assertState(t, b, StateClosed)
+	if !b.Allow() {
+		t.Fatal("expected a breaker which can no longer open to let calls through")
+	}
+}
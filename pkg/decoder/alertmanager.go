@@ -0,0 +1,22 @@
+package decoder
+
+import (
+	"encoding/json"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// alertmanagerDecoder decodes the webhook messages of Alertmanager.
+type alertmanagerDecoder struct{}
+
+func (alertmanagerDecoder) Detect(v interface{}) bool {
+	return hasKeys(v, "alerts")
+}
+
+func (alertmanagerDecoder) Decode(body []byte) (*models.WebhookMessage, error) {
+	var m models.WebhookMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,225 @@
+// Package decoder normalizes the alert payloads of various senders into
+// webhook messages, so that they go through the same templates and targets as
+// those of Alertmanager.
+package decoder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+const (
+	// Default is the decoder of payloads when none is configured.
+	Default = "alertmanager"
+	// Auto selects the decoder by sniffing the payload.
+	Auto = "auto"
+)
+
+// ErrUnknownPayload is returned when no decoder recognizes a payload.
+var ErrUnknownPayload = errors.New("no decoder recognizes the payload")
+
+// Decoder decodes the payloads of one kind of sender.
+type Decoder interface {
+	// Detect tells whether the payload, unmarshaled as generic JSON, looks
+	// like one of the sender.
+	Detect(v interface{}) bool
+	// Decode normalizes the payload into a webhook message.
+	Decode(body []byte) (*models.WebhookMessage, error)
+}
+
+type registered struct {
+	name    string
+	decoder Decoder
+}
+
+// decoders are sniffed in registration order, so the most specific ones must
+// be registered first.
+var decoders []registered
+
+func init() {
+	Register("grafana", grafanaDecoder{})
+	Register("alertmanager", alertmanagerDecoder{})
+	Register("vmalert", vmalertDecoder{})
+	Register("generic", genericDecoder{})
+}
+
+// Register makes the decoder available under the given name, it panics if
+// the name is already taken.
+func Register(name string, d Decoder) {
+	if _, ok := Lookup(name); ok || name == Auto {
+		panic(fmt.Sprintf("decoder %q already registered", name))
+	}
+	decoders = append(decoders, registered{name: name, decoder: d})
+}
+
+// Lookup returns the decoder registered under the given name.
+func Lookup(name string) (Decoder, bool) {
+	for _, r := range decoders {
+		if r.name == name {
+			return r.decoder, true
+		}
+	}
+	return nil, false
+}
+
+// Names returns the names of the registered decoders, in sniffing order.
+func Names() []string {
+	names := make([]string, 0, len(decoders))
+	for _, r := range decoders {
+		names = append(names, r.name)
+	}
+	return names
+}
+
+// Decode decodes the payload with the named decoder, Default if name is
+// empty, or with the first one detecting it if name is Auto. It returns the
+// name of the decoder used. The payload is kept in the Raw field of the
+// message.
+func Decode(name string, body []byte) (*models.WebhookMessage, string, error) {
+	var raw interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, name, err
+	}
+
+	if name == "" {
+		name = Default
+	}
+
+	var d Decoder
+	if name == Auto {
+		for _, r := range decoders {
+			if r.decoder.Detect(raw) {
+				name, d = r.name, r.decoder
+				break
+			}
+		}
+		if d == nil {
+			return nil, Auto, ErrUnknownPayload
+		}
+	} else {
+		var ok bool
+		if d, ok = Lookup(name); !ok {
+			return nil, name, fmt.Errorf("unknown decoder %q", name)
+		}
+	}
+
+	m, err := d.Decode(body)
+	if err != nil {
+		return nil, name, err
+	}
+	m.Raw = raw
+	return m, name, nil
+}
+
+// newMessage groups alerts which do not come from Alertmanager into a
+// message. The alerts are grouped by alert name when they share it, the
+// fingerprints and statuses of the alerts are filled in when missing, the
+// fingerprints from the labels only.
+func newMessage(alerts models.Alerts) *models.WebhookMessage {
+	now := time.Now()
+	for i := range alerts {
+		a := &alerts[i]
+		if a.Labels == nil {
+			a.Labels = models.KV{}
+		}
+		if a.Annotations == nil {
+			a.Annotations = models.KV{}
+		}
+		if a.Fingerprint == "" {
+			a.Fingerprint = labelSet(a.Labels).Fingerprint().String()
+		}
+		if a.Status == "" {
+			a.Status = string(model.AlertFiring)
+			if !a.EndsAt.IsZero() && a.EndsAt.Before(now) {
+				a.Status = string(model.AlertResolved)
+			}
+		}
+	}
+
+	m := &models.WebhookMessage{
+		Status:            string(model.AlertResolved),
+		Alerts:            alerts,
+		GroupLabels:       models.KV{},
+		CommonLabels:      commonKV(alerts, func(a *models.Alert) models.KV { return a.Labels }),
+		CommonAnnotations: commonKV(alerts, func(a *models.Alert) models.KV { return a.Annotations }),
+	}
+	if len(alerts.Firing()) > 0 {
+		m.Status = string(model.AlertFiring)
+	}
+	if alertname, ok := m.CommonLabels[string(model.AlertNameLabel)]; ok {
+		m.GroupLabels[string(model.AlertNameLabel)] = alertname
+	}
+	m.GroupKey = "{}:" + labelSet(m.GroupLabels).String()
+	return m
+}
+
+// commonKV returns the pairs shared by all the alerts.
+func commonKV(alerts models.Alerts, kv func(a *models.Alert) models.KV) models.KV {
+	common := models.KV{}
+	if len(alerts) == 0 {
+		return common
+	}
+	for k, v := range kv(&alerts[0]) {
+		common[k] = v
+	}
+	for i := range alerts[1:] {
+		pairs := kv(&alerts[i+1])
+		for k, v := range common {
+			if pairs[k] != v {
+				delete(common, k)
+			}
+		}
+	}
+	return common
+}
+
+func labelSet(kv models.KV) model.LabelSet {
+	ls := make(model.LabelSet, len(kv))
+	for k, v := range kv {
+		ls[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return ls
+}
+
+// toKV converts a JSON object into pairs, values which are not strings are
+// formatted as JSON.
+func toKV(v interface{}) models.KV {
+	obj, _ := v.(map[string]interface{})
+	kv := make(models.KV, len(obj))
+	for k, v := range obj {
+		kv[k] = toString(v)
+	}
+	return kv
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// hasKeys tells whether v is a JSON object holding all the keys.
+func hasKeys(v interface{}, keys ...string) bool {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, k := range keys {
+		if _, ok := obj[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package decoder
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	alertmanagerPayload = `{
+		"version": "4",
+		"status": "firing",
+		"groupKey": "{}:{alertname=\"HighLoad\"}",
+		"groupLabels": {"alertname": "HighLoad"},
+		"commonLabels": {"alertname": "HighLoad"},
+		"alerts": [
+			{"status": "firing", "labels": {"alertname": "HighLoad", "instance": "db1"}, "fingerprint": "0123456789abcdef"}
+		]
+	}`
+	grafanaPayload = `{
+		"orgId": 1,
+		"title": "[FIRING:1] HighLoad",
+		"message": "Load is high",
+		"alerts": [
+			{"status": "firing", "labels": {"alertname": "HighLoad", "instance": "db1"}, "values": {"A": 3}}
+		]
+	}`
+	vmalertPayload = `[
+		{"labels": {"alertname": "HighLoad", "instance": "db1"}, "startsAt": "2020-01-01T00:00:00Z"},
+		{"labels": {"alertname": "HighLoad", "instance": "db2"}, "endsAt": "2020-01-01T01:00:00Z"}
+	]`
+	genericPayload = `{"title": "Backup failed", "host": "db1", "severity": "critical", "status": "ok"}`
+)
+
+func TestDecodeSniffingOrder(t *testing.T) {
+	for _, tc := range []struct {
+		payload string
+		want    string
+	}{
+		// Grafana payloads are Alertmanager ones with extra fields, they
+		// must be detected first.
+		{grafanaPayload, "grafana"},
+		{alertmanagerPayload, "alertmanager"},
+		// Arrays of alerts are also arrays of objects, vmalert must be
+		// detected before the catch-all generic decoder.
+		{vmalertPayload, "vmalert"},
+		{genericPayload, "generic"},
+		{`[{"title": "Backup failed"}]`, "generic"},
+	} {
+		m, name, err := Decode(Auto, []byte(tc.payload))
+		if err != nil {
+			t.Fatalf("decoding %s: %s", tc.payload, err)
+		}
+		if name != tc.want {
+			t.Errorf("got decoder %q for %s, want %q", name, tc.payload, tc.want)
+		}
+		if m.Raw == nil {
+			t.Errorf("expected the raw payload to be kept for %s", tc.payload)
+		}
+	}
+}
+
+func TestDecodeUnknownPayload(t *testing.T) {
+	for _, payload := range []string{`"alert"`, `[]`, `[1, 2]`, `42`} {
+		if _, _, err := Decode(Auto, []byte(payload)); !errors.Is(err, ErrUnknownPayload) {
+			t.Errorf("expected %s not to be recognized, got %v", payload, err)
+		}
+	}
+	if _, _, err := Decode(Auto, []byte(`{`)); err == nil || errors.Is(err, ErrUnknownPayload) {
+		t.Errorf("expected a syntax error, got %v", err)
+	}
+}
+
+func TestDecodeDefault(t *testing.T) {
+	// Payloads are not sniffed unless asked to.
+	_, name, err := Decode("", []byte(genericPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != Default {
+		t.Fatalf("got decoder %q, want %q", name, Default)
+	}
+
+	if _, _, err := Decode("nope", []byte(genericPayload)); err == nil {
+		t.Fatal("expected an error for an unknown decoder")
+	}
+}
+
+func TestAlertmanagerDecoder(t *testing.T) {
+	m, _, err := Decode("alertmanager", []byte(alertmanagerPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Alerts) != 1 || m.Alerts[0].Fingerprint != "0123456789abcdef" {
+		t.Fatalf("unexpected alerts %+v", m.Alerts)
+	}
+	if m.GroupKey != `{}:{alertname="HighLoad"}` {
+		t.Fatalf("got group key %q", m.GroupKey)
+	}
+}
+
+func TestGrafanaDecoder(t *testing.T) {
+	m, _, err := Decode("grafana", []byte(grafanaPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Status != "firing" {
+		t.Errorf("got status %q, want firing", m.Status)
+	}
+	if m.GroupKey != `{}:{alertname="HighLoad"}` {
+		t.Errorf("got group key %q", m.GroupKey)
+	}
+	if m.CommonLabels["instance"] != "db1" {
+		t.Errorf("got common labels %v", m.CommonLabels)
+	}
+	if raw, _ := m.Raw.(map[string]interface{}); raw["message"] != "Load is high" {
+		t.Errorf("expected the message in the raw payload, got %v", m.Raw)
+	}
+}
+
+func TestVmalertDecoder(t *testing.T) {
+	m, _, err := Decode("vmalert", []byte(vmalertPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Alerts) != 2 {
+		t.Fatalf("got %d alerts, want 2", len(m.Alerts))
+	}
+	if m.Alerts[0].Status != "firing" || m.Alerts[1].Status != "resolved" {
+		t.Errorf("got statuses %q and %q, want firing and resolved", m.Alerts[0].Status, m.Alerts[1].Status)
+	}
+	if m.Alerts[0].Fingerprint == "" || m.Alerts[0].Fingerprint == m.Alerts[1].Fingerprint {
+		t.Errorf("expected distinct fingerprints, got %q and %q", m.Alerts[0].Fingerprint, m.Alerts[1].Fingerprint)
+	}
+	if m.Status != "firing" {
+		t.Errorf("got status %q, want firing", m.Status)
+	}
+	if m.GroupLabels["alertname"] != "HighLoad" || m.CommonLabels["instance"] != "" {
+		t.Errorf("got group labels %v and common labels %v", m.GroupLabels, m.CommonLabels)
+	}
+}
+
+func TestGenericDecoder(t *testing.T) {
+	m, _, err := Decode("generic", []byte(genericPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(m.Alerts))
+	}
+	a := m.Alerts[0]
+	if a.Status != "resolved" {
+		t.Errorf("got status %q, want resolved", a.Status)
+	}
+	if a.Labels["alertname"] != "Backup failed" || a.Labels["host"] != "db1" || a.Labels["severity"] != "critical" {
+		t.Errorf("got labels %v", a.Labels)
+	}
+	if _, ok := a.Labels["title"]; ok {
+		t.Errorf("expected the title not to be a label, got %v", a.Labels)
+	}
+	if a.Annotations["title"] != "Backup failed" || a.Annotations["summary"] != "Backup failed" {
+		t.Errorf("got annotations %v", a.Annotations)
+	}
+	if a.StartsAt.IsZero() {
+		t.Error("expected the start time to be filled in")
+	}
+}
+
+func TestGenericDecoderFingerprints(t *testing.T) {
+	fingerprint := func(payload string) string {
+		t.Helper()
+		m, _, err := Decode("generic", []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Alerts[0].Fingerprint
+	}
+
+	a := fingerprint(`{"host": "db1", "message": "Disk full"}`)
+	if b := fingerprint(`{"message": "Disk full", "host": "db1"}`); a != b {
+		t.Errorf("expected the same fingerprint regardless of field order, got %q and %q", a, b)
+	}
+	// Alerts sharing their labels are told apart by their annotations.
+	if b := fingerprint(`{"host": "db1", "message": "Backup failed"}`); a == b {
+		t.Errorf("expected distinct fingerprints for distinct annotations, got %q", a)
+	}
+	if len(a) != 16 {
+		t.Errorf("got fingerprint %q, want 16 hexadecimal digits", a)
+	}
+}
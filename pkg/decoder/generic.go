@@ -0,0 +1,133 @@
+package decoder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// genericAnnotations are the fields of generic payloads taken as annotations
+// rather than labels.
+var genericAnnotations = map[string]bool{
+	"title":       true,
+	"summary":     true,
+	"description": true,
+	"message":     true,
+}
+
+// genericDecoder decodes arbitrary JSON objects, or arrays of them, each
+// object being an alert:
+//
+//   - labels and annotations objects are taken as is,
+//   - status is "firing" unless "resolved" or "ok",
+//   - startsAt, endsAt and generatorURL are taken as is,
+//   - title, summary, description and message are taken as annotations, the
+//     title is also the alert name and summary unless they are set,
+//   - any other field is taken as a label.
+//
+// Generic payloads often carry few labels, alerts are thus told apart by
+// their annotations as well.
+type genericDecoder struct{}
+
+func (genericDecoder) Detect(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return true
+	case []interface{}:
+		for _, a := range v {
+			if _, ok := a.(map[string]interface{}); !ok {
+				return false
+			}
+		}
+		return len(v) > 0
+	}
+	return false
+}
+
+func (genericDecoder) Decode(body []byte) (*models.WebhookMessage, error) {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+
+	objs, ok := v.([]interface{})
+	if !ok {
+		objs = []interface{}{v}
+	}
+	alerts := make(models.Alerts, 0, len(objs))
+	for _, o := range objs {
+		obj, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("alerts must be JSON objects")
+		}
+		a, err := genericAlert(obj)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return newMessage(alerts), nil
+}
+
+func genericAlert(obj map[string]interface{}) (models.Alert, error) {
+	a := models.Alert{
+		Status:      string(model.AlertFiring),
+		Labels:      toKV(obj["labels"]),
+		Annotations: toKV(obj["annotations"]),
+	}
+	for k, v := range obj {
+		var err error
+		switch {
+		case k == "labels" || k == "annotations":
+		case k == "status":
+			if s := toString(v); s == string(model.AlertResolved) || s == "ok" {
+				a.Status = string(model.AlertResolved)
+			}
+		case k == "startsAt":
+			a.StartsAt, err = time.Parse(time.RFC3339, toString(v))
+		case k == "endsAt":
+			a.EndsAt, err = time.Parse(time.RFC3339, toString(v))
+		case k == "generatorURL":
+			a.GeneratorURL = toString(v)
+		case genericAnnotations[k]:
+			if _, ok := a.Annotations[k]; !ok {
+				a.Annotations[k] = toString(v)
+			}
+		default:
+			if _, ok := a.Labels[k]; !ok {
+				a.Labels[k] = toString(v)
+			}
+		}
+		if err != nil {
+			return a, err
+		}
+	}
+	if title := a.Annotations["title"]; title != "" {
+		if a.Labels[string(model.AlertNameLabel)] == "" {
+			a.Labels[string(model.AlertNameLabel)] = title
+		}
+		if a.Annotations["summary"] == "" {
+			a.Annotations["summary"] = title
+		}
+	}
+	if a.StartsAt.IsZero() {
+		a.StartsAt = time.Now()
+	}
+	a.Fingerprint = genericFingerprint(a.Labels, a.Annotations)
+	return a, nil
+}
+
+// genericFingerprint hashes both the labels and the annotations, as
+// Alertmanager fingerprints are formatted.
+func genericFingerprint(labels, annotations models.KV) string {
+	// Maps are marshaled with sorted keys.
+	b, _ := json.Marshal([]models.KV{labels, annotations})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
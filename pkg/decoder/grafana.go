@@ -0,0 +1,41 @@
+package decoder
+
+import (
+	"encoding/json"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// grafanaDecoder decodes the webhook messages of Grafana unified alerting.
+// They extend those of Alertmanager, the extra fields such as the title,
+// message and values of the alerts are only available in Raw.
+type grafanaDecoder struct{}
+
+func (grafanaDecoder) Detect(v interface{}) bool {
+	return hasKeys(v, "alerts", "orgId")
+}
+
+func (grafanaDecoder) Decode(body []byte) (*models.WebhookMessage, error) {
+	var m models.WebhookMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	// Fill in what older Grafana versions leave out.
+	normalized := newMessage(m.Alerts)
+	if m.GroupKey == "" {
+		m.GroupKey = normalized.GroupKey
+	}
+	if m.GroupLabels == nil {
+		m.GroupLabels = normalized.GroupLabels
+	}
+	if m.CommonLabels == nil {
+		m.CommonLabels = normalized.CommonLabels
+	}
+	if m.CommonAnnotations == nil {
+		m.CommonAnnotations = normalized.CommonAnnotations
+	}
+	if m.Status == "" {
+		m.Status = normalized.Status
+	}
+	return &m, nil
+}
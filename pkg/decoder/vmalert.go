@@ -0,0 +1,33 @@
+package decoder
+
+import (
+	"encoding/json"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// vmalertDecoder decodes the alerts vmalert, like Prometheus, posts to the
+// Alertmanager API: a JSON array of alerts, without status nor fingerprint.
+// The alerts are resolved once their end time is past.
+type vmalertDecoder struct{}
+
+func (vmalertDecoder) Detect(v interface{}) bool {
+	alerts, ok := v.([]interface{})
+	if !ok || len(alerts) == 0 {
+		return false
+	}
+	for _, a := range alerts {
+		if !hasKeys(a, "labels") {
+			return false
+		}
+	}
+	return true
+}
+
+func (vmalertDecoder) Decode(body []byte) (*models.WebhookMessage, error) {
+	var alerts models.Alerts
+	if err := json.Unmarshal(body, &alerts); err != nil {
+		return nil, err
+	}
+	return newMessage(alerts), nil
+}
@@ -0,0 +1,458 @@
+// Package history implements a bounded store of delivered notifications
+// backed by an embedded bbolt database.
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+var (
+	entriesBucket = []byte("entries")
+	// timesBucket indexes the entries by time, its keys are the time of the
+	// entries in nanoseconds followed by their ID.
+	timesBucket = []byte("times")
+)
+
+// DefaultMaxScan is the number of entries a query examines at most when
+// Query.MaxScan is not set.
+const DefaultMaxScan = 100000
+
+var (
+	// ErrNotFound is returned by Get when there is no entry with the given ID.
+	ErrNotFound = errors.New("notification not found")
+	// ErrTargetNotFound is returned when resending to a target which no
+	// longer exists.
+	ErrTargetNotFound = errors.New("target not found")
+	// ErrDisabled is returned by users of the store when the history is
+	// disabled, that is when no storage path is configured.
+	ErrDisabled = errors.New("notification history is disabled, no storage path is configured")
+)
+
+// Options bound the size of the store.
+type Options struct {
+	// Retention is how long entries are kept, forever when zero.
+	Retention time.Duration
+	// MaxEntries is the maximum number of entries kept, unbounded when zero.
+	MaxEntries int
+	// Logger logs the entries which cannot be decoded, nothing is logged
+	// when nil.
+	Logger log.Logger
+}
+
+// Source describes the alerts a notification was rendered from, and the
+// notification it resends if any.
+type Source struct {
+	Status       string    `json:"status"`
+	GroupKey     string    `json:"groupKey"`
+	GroupLabels  models.KV `json:"groupLabels"`
+	Fingerprints []string  `json:"fingerprints"`
+	// ResendOf is the ID of the original notification when resending.
+	ResendOf uint64 `json:"resendOf,omitempty"`
+	// DeliveryID identifies a notification across all the attempts to
+	// deliver it: retries from the queue, redeliveries by the sender, sends
+	// to fallback targets and resends.
+	DeliveryID string `json:"deliveryId,omitempty"`
+}
+
+// WithDeliveryID returns a copy of the source identifying the given part of
+// the notifications rendered from it for the target. The ID only depends on
+// the alerts, so that the same alerts delivered again get the same ID.
+func (s Source) WithDeliveryID(target string, part int) Source {
+	fingerprints := append([]string(nil), s.Fingerprints...)
+	sort.Strings(fingerprints)
+
+	h := sha256.New()
+	for _, v := range []string{target, s.GroupKey, s.Status, strings.Join(fingerprints, ","), strconv.Itoa(part)} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	s.DeliveryID = hex.EncodeToString(h.Sum(nil)[:16])
+	return s
+}
+
+// NewSource returns the source of the notifications rendered from m.
+func NewSource(m *models.WebhookMessage) Source {
+	fingerprints := make([]string, 0, len(m.Alerts))
+	for _, a := range m.Alerts {
+		fingerprints = append(fingerprints, a.Fingerprint)
+	}
+	return Source{
+		Status:       m.Status,
+		GroupKey:     m.GroupKey,
+		GroupLabels:  m.GroupLabels,
+		Fingerprints: fingerprints,
+	}
+}
+
+// Entry records the delivery of a notification to a target.
+type Entry struct {
+	ID     uint64    `json:"id"`
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Source
+
+	// Title and Text summarize the notification, they are not stored but
+	// derived from it when reading the entry.
+	Title        string                       `json:"title"`
+	Text         string                       `json:"text"`
+	Notification *models.DingTalkNotification `json:"notification"`
+
+	Success  bool                                 `json:"success"`
+	Response *models.DingTalkNotificationResponse `json:"response,omitempty"`
+	Error    string                               `json:"error,omitempty"`
+	// Latency is the duration of the delivery in seconds, including retries.
+	Latency  float64 `json:"latency"`
+	Attempts int     `json:"attempts"`
+}
+
+// ResendResult is the outcome of resending a notification of the history.
+type ResendResult struct {
+	ID       uint64                               `json:"id"`
+	Target   string                               `json:"target"`
+	Success  bool                                 `json:"success"`
+	Response *models.DingTalkNotificationResponse `json:"response,omitempty"`
+	Error    string                               `json:"error,omitempty"`
+}
+
+// Query filters the entries returned by Store.Query, zero fields match
+// everything.
+type Query struct {
+	Target      string
+	Status      string
+	Fingerprint string
+	// Search matches the title and the text, case-insensitively.
+	Search  string
+	Success *bool
+	Start   time.Time
+	End     time.Time
+	Limit   int
+	// MaxScan bounds the number of entries examined, DefaultMaxScan when
+	// zero. Entries out of the time range do not count when it is given.
+	MaxScan int
+}
+
+func (q *Query) matches(e *Entry) bool {
+	if q.Target != "" && e.Target != q.Target {
+		return false
+	}
+	if q.Status != "" && e.Status != q.Status {
+		return false
+	}
+	if q.Success != nil && e.Success != *q.Success {
+		return false
+	}
+	if !q.Start.IsZero() && e.Time.Before(q.Start) {
+		return false
+	}
+	if !q.End.IsZero() && e.Time.After(q.End) {
+		return false
+	}
+	if q.Fingerprint != "" && !contains(e.Fingerprints, q.Fingerprint) {
+		return false
+	}
+	if q.Search != "" {
+		search := strings.ToLower(q.Search)
+		if !strings.Contains(strings.ToLower(e.Title), search) && !strings.Contains(strings.ToLower(e.Text), search) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps the entries ordered by ID, which is assigned in insertion order.
+type Store struct {
+	db   *bolt.DB
+	opts Options
+}
+
+// Open opens (or creates) the store at path.
+func Open(path string, opts Options) (*Store, error) {
+	db, err := bolt.Open(path, 0o640, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+	s := &Store{db: db, opts: opts}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		entries, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(timesBucket) != nil {
+			return nil
+		}
+		// Stores created before the index existed are indexed once.
+		times, err := tx.CreateBucket(timesBucket)
+		if err != nil {
+			return err
+		}
+		return entries.ForEach(func(k, v []byte) error {
+			e, err := s.decode(k, v)
+			if err != nil {
+				return nil
+			}
+			return times.Put(timeKey(e.Time, e.ID), nil)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Add stores the entry, assigning its ID. The title and text are taken from
+// the notification if any. The oldest entries are dropped when the store
+// holds more than Options.MaxEntries.
+func (s *Store) Add(e *Entry) error {
+	stored := *e
+	if e.Notification != nil {
+		e.Title, e.Text = summarize(e.Notification)
+		stored.Title, stored.Text = "", ""
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.ID, stored.ID = id, id
+
+		v, err := json.Marshal(&stored)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(itob(id), v); err != nil {
+			return err
+		}
+		times := tx.Bucket(timesBucket)
+		if err := times.Put(timeKey(e.Time, id), nil); err != nil {
+			return err
+		}
+
+		if s.opts.MaxEntries <= 0 || id <= uint64(s.opts.MaxEntries) {
+			return nil
+		}
+		// Entries are only ever deleted from the head, so everything before
+		// the window of the last MaxEntries IDs is to be dropped.
+		oldest := itob(id - uint64(s.opts.MaxEntries) + 1)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && string(k) < string(oldest); k, v = c.First() {
+			// Undecodable entries leave a dangling key in the index, which
+			// is skipped by queries and dropped by Truncate.
+			if old, err := s.decode(k, v); err == nil {
+				if err := times.Delete(timeKey(old.Time, old.ID)); err != nil {
+					return err
+				}
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get returns the entry with the given ID.
+func (s *Store) Get(id uint64) (*Entry, error) {
+	var e *Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k := itob(id)
+		v := tx.Bucket(entriesBucket).Get(k)
+		if v == nil {
+			return ErrNotFound
+		}
+		var err error
+		e, err = s.decode(k, v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Query returns the entries matching q, newest first. When q has a time
+// range, only the entries within it are examined. Entries which cannot be
+// decoded are logged and skipped. The query gives up once it examined
+// q.MaxScan entries, returning what it found so far.
+func (s *Store) Query(q Query) ([]*Entry, error) {
+	maxScan := q.MaxScan
+	if maxScan <= 0 {
+		maxScan = DefaultMaxScan
+	}
+
+	entries := []*Entry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket)
+		scanned := 0
+		visit := func(k, v []byte) bool {
+			if scanned++; scanned > maxScan {
+				level.Warn(s.opts.Logger).Log("msg", "Notification history query examined too many entries, results are partial", "maxScan", maxScan)
+				return false
+			}
+			e, err := s.decode(k, v)
+			if err != nil {
+				return true
+			}
+			if !q.matches(e) {
+				return true
+			}
+			entries = append(entries, e)
+			return q.Limit <= 0 || len(entries) < q.Limit
+		}
+
+		if q.Start.IsZero() && q.End.IsZero() {
+			c := b.Cursor()
+			for k, v := c.Last(); k != nil && visit(k, v); k, v = c.Prev() {
+			}
+			return nil
+		}
+
+		c := tx.Bucket(timesBucket).Cursor()
+		var k []byte
+		if q.End.IsZero() {
+			k, _ = c.Last()
+		} else if k, _ = c.Seek(timeKey(q.End, math.MaxUint64)); k == nil {
+			k, _ = c.Last()
+		} else if string(k) > string(timeKey(q.End, math.MaxUint64)) {
+			k, _ = c.Prev()
+		}
+		start := timeKey(q.Start, 0)
+		for ; k != nil && string(k) >= string(start); k, _ = c.Prev() {
+			id := k[8:]
+			v := b.Get(id)
+			if v == nil {
+				// Left behind by an entry which could not be decoded.
+				continue
+			}
+			if !visit(id, v) {
+				break
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Truncate drops the entries older than Options.Retention and returns how many
+// were dropped.
+func (s *Store) Truncate(now time.Time) (int, error) {
+	if s.opts.Retention <= 0 {
+		return 0, nil
+	}
+	mint := now.Add(-s.opts.Retention)
+
+	var n int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket)
+		times := tx.Bucket(timesBucket)
+		end := timeKey(mint, 0)
+		c := times.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(end); k, _ = c.First() {
+			id := k[8:]
+			if b.Get(id) != nil {
+				if err := b.Delete(id); err != nil {
+					return err
+				}
+				n++
+			}
+			if err := times.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// decode decodes the entry stored under k, filling in its title and text. It
+// logs the entries which cannot be decoded.
+func (s *Store) decode(k, v []byte) (*Entry, error) {
+	var e Entry
+	if err := json.Unmarshal(v, &e); err != nil {
+		level.Warn(s.opts.Logger).Log("msg", "Skipping undecodable notification history entry", "id", binary.BigEndian.Uint64(k), "err", err)
+		return nil, err
+	}
+	if e.Notification != nil {
+		e.Title, e.Text = summarize(e.Notification)
+	}
+	return &e, nil
+}
+
+// summarize returns the title and the text of the notification, whatever its
+// message type.
+func summarize(n *models.DingTalkNotification) (title, text string) {
+	switch {
+	case n.Markdown != nil:
+		return n.Markdown.Title, n.Markdown.Text
+	case n.ActionCard != nil:
+		return n.ActionCard.Title, n.ActionCard.Text
+	case n.Link != nil:
+		return n.Link.Title, n.Link.Text
+	case n.Text != nil:
+		return n.Text.Title, n.Text.Content
+	case n.FeedCard != nil:
+		titles := make([]string, 0, len(n.FeedCard.Links))
+		for _, l := range n.FeedCard.Links {
+			titles = append(titles, l.Title)
+		}
+		if len(titles) > 0 {
+			title = titles[0]
+		}
+		return title, strings.Join(titles, "\n")
+	}
+	return "", ""
+}
+
+// timeKey returns the key of the entry in the time index. Times before the
+// epoch, such as the zero time, sort first.
+func timeKey(t time.Time, id uint64) []byte {
+	b := make([]byte, 16)
+	var ns uint64
+	if !t.IsZero() && t.UnixNano() > 0 {
+		ns = uint64(t.UnixNano())
+	}
+	binary.BigEndian.PutUint64(b, ns)
+	binary.BigEndian.PutUint64(b[8:], id)
+	return b
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,231 @@
+package history
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func mustOpen(t *testing.T, path string, opts Options) *Store {
+	t.Helper()
+	s, err := Open(path, opts)
+	if err != nil {
+		t.Fatalf("opening store: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// mustAdd stores a markdown notification with the given title to the target,
+// made at epoch plus the given number of minutes, and returns its ID.
+func mustAdd(t *testing.T, s *Store, target string, minutes int, title string) uint64 {
+	t.Helper()
+	e := &Entry{
+		Time:   epoch.Add(time.Duration(minutes) * time.Minute),
+		Target: target,
+		Source: Source{Status: "firing", Fingerprints: []string{title}},
+		Notification: &models.DingTalkNotification{
+			MessageType: "markdown",
+			Markdown:    &models.DingTalkNotificationMarkdown{Title: title, Text: "text of " + title},
+		},
+		Success: true,
+	}
+	if err := s.Add(e); err != nil {
+		t.Fatalf("adding %q: %s", title, err)
+	}
+	return e.ID
+}
+
+func mustQuery(t *testing.T, s *Store, q Query) []string {
+	t.Helper()
+	entries, err := s.Query(q)
+	if err != nil {
+		t.Fatalf("querying %+v: %s", q, err)
+	}
+	titles := make([]string, 0, len(entries))
+	for _, e := range entries {
+		titles = append(titles, e.Title)
+	}
+	return titles
+}
+
+func assertTitles(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestQueryTimeRange(t *testing.T) {
+	s := mustOpen(t, filepath.Join(t.TempDir(), "history.db"), Options{})
+	// Entries are not necessarily added in time order, e.g. when the
+	// queue delivers old notifications.
+	for _, e := range []struct {
+		minutes int
+		title   string
+	}{{10, "a"}, {30, "c"}, {20, "b"}, {50, "e"}, {40, "d"}} {
+		mustAdd(t, s, "webhook", e.minutes, e.title)
+	}
+
+	// Without a time range, entries come newest first by insertion.
+	assertTitles(t, mustQuery(t, s, Query{}), "d", "e", "b", "c", "a")
+
+	// Within a time range, they come newest first by time, bounds included.
+	assertTitles(t, mustQuery(t, s, Query{
+		Start: epoch.Add(20 * time.Minute),
+		End:   epoch.Add(40 * time.Minute),
+	}), "d", "c", "b")
+	assertTitles(t, mustQuery(t, s, Query{Start: epoch.Add(35 * time.Minute)}), "e", "d")
+	assertTitles(t, mustQuery(t, s, Query{End: epoch.Add(25 * time.Minute)}), "b", "a")
+	assertTitles(t, mustQuery(t, s, Query{End: epoch.Add(time.Hour), Limit: 2}), "e", "d")
+	assertTitles(t, mustQuery(t, s, Query{Start: epoch.Add(time.Hour)}))
+}
+
+func TestQueryFilters(t *testing.T) {
+	s := mustOpen(t, filepath.Join(t.TempDir(), "history.db"), Options{})
+	mustAdd(t, s, "webhook1", 0, "Disk full")
+	mustAdd(t, s, "webhook2", 1, "Backup failed")
+	failed := &Entry{Time: epoch.Add(2 * time.Minute), Target: "webhook1", Error: "boom"}
+	if err := s.Add(failed); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTitles(t, mustQuery(t, s, Query{Target: "webhook2"}), "Backup failed")
+	assertTitles(t, mustQuery(t, s, Query{Fingerprint: "Disk full"}), "Disk full")
+	// Titles and texts are derived from the notifications on read.
+	assertTitles(t, mustQuery(t, s, Query{Search: "TEXT OF backup"}), "Backup failed")
+
+	success := false
+	entries, err := s.Query(Query{Success: &success})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != failed.ID {
+		t.Fatalf("got %+v, want the failed entry only", entries)
+	}
+}
+
+func TestMaxEntriesEviction(t *testing.T) {
+	s := mustOpen(t, filepath.Join(t.TempDir(), "history.db"), Options{MaxEntries: 3})
+	ids := make([]uint64, 0, 5)
+	for i, title := range []string{"a", "b", "c", "d", "e"} {
+		// The oldest entries are evicted by insertion, not by time.
+		ids = append(ids, mustAdd(t, s, "webhook", 10-i, title))
+	}
+
+	assertTitles(t, mustQuery(t, s, Query{}), "e", "d", "c")
+	// Evicted entries are dropped from the time index too.
+	assertTitles(t, mustQuery(t, s, Query{Start: epoch}), "c", "d", "e")
+	for _, id := range ids[:2] {
+		if _, err := s.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected entry %d to be evicted, got %v", id, err)
+		}
+	}
+	if e, err := s.Get(ids[2]); err != nil || e.Title != "c" {
+		t.Fatalf("got %+v, %v, want entry c", e, err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	s := mustOpen(t, filepath.Join(t.TempDir(), "history.db"), Options{Retention: time.Hour})
+	mustAdd(t, s, "webhook", 30, "b")
+	mustAdd(t, s, "webhook", 0, "a")
+	mustAdd(t, s, "webhook", 90, "c")
+	mustAdd(t, s, "webhook", 120, "d")
+
+	now := epoch.Add(2 * time.Hour)
+	n, err := s.Truncate(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("got %d entries dropped, want 2", n)
+	}
+	assertTitles(t, mustQuery(t, s, Query{}), "d", "c")
+	assertTitles(t, mustQuery(t, s, Query{End: now}), "d", "c")
+
+	if n, err := s.Truncate(now); err != nil || n != 0 {
+		t.Fatalf("got %d, %v, want nothing more to drop", n, err)
+	}
+}
+
+func TestTruncateWithoutRetention(t *testing.T) {
+	s := mustOpen(t, filepath.Join(t.TempDir(), "history.db"), Options{})
+	mustAdd(t, s, "webhook", 0, "a")
+
+	if n, err := s.Truncate(epoch.Add(24 * time.Hour)); err != nil || n != 0 {
+		t.Fatalf("got %d, %v, want entries to be kept forever", n, err)
+	}
+}
+
+func TestUndecodableEntriesSkipped(t *testing.T) {
+	s := mustOpen(t, filepath.Join(t.TempDir(), "history.db"), Options{MaxEntries: 3})
+	mustAdd(t, s, "webhook", 0, "a")
+	corrupted := mustAdd(t, s, "webhook", 1, "b")
+	mustAdd(t, s, "webhook", 2, "c")
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put(itob(corrupted), []byte("{"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTitles(t, mustQuery(t, s, Query{}), "c", "a")
+	assertTitles(t, mustQuery(t, s, Query{Start: epoch}), "c", "a")
+	if _, err := s.Get(corrupted); err == nil {
+		t.Fatal("expected an error getting the undecodable entry")
+	}
+
+	// Undecodable entries are evicted like the others.
+	mustAdd(t, s, "webhook", 3, "d")
+	mustAdd(t, s, "webhook", 4, "e")
+	assertTitles(t, mustQuery(t, s, Query{}), "e", "d", "c")
+	assertTitles(t, mustQuery(t, s, Query{Start: epoch}), "e", "d", "c")
+}
+
+func TestQueryMaxScan(t *testing.T) {
+	s := mustOpen(t, filepath.Join(t.TempDir(), "history.db"), Options{})
+	mustAdd(t, s, "webhook1", 0, "a")
+	mustAdd(t, s, "webhook2", 1, "b")
+	mustAdd(t, s, "webhook2", 2, "c")
+	mustAdd(t, s, "webhook1", 3, "d")
+
+	// The query gives up before reaching the oldest entry of webhook1.
+	assertTitles(t, mustQuery(t, s, Query{Target: "webhook1", MaxScan: 3}), "d")
+	assertTitles(t, mustQuery(t, s, Query{Target: "webhook1", Start: epoch, MaxScan: 3}), "d")
+	assertTitles(t, mustQuery(t, s, Query{Target: "webhook1"}), "d", "a")
+}
+
+func TestOpenIndexesOldStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, title := range []string{"a", "b", "c"} {
+		mustAdd(t, s, "webhook", i, title)
+	}
+	// Stores created before the time index existed have none.
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(timesBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = mustOpen(t, path, Options{})
+	assertTitles(t, mustQuery(t, s, Query{Start: epoch.Add(time.Minute)}), "c", "b")
+}
@@ -1,5 +1,14 @@
 package models
 
+// DingTalk robot message types.
+const (
+	MessageTypeText       = "text"
+	MessageTypeLink       = "link"
+	MessageTypeMarkdown   = "markdown"
+	MessageTypeActionCard = "actionCard"
+	MessageTypeFeedCard   = "feedCard"
+)
+
 type DingTalkNotificationResponse struct {
 	ErrorMessage string `json:"errmsg"`
 	ErrorCode    int    `json:"errcode"`
@@ -11,6 +20,7 @@ type DingTalkNotification struct {
 	Link        *DingTalkNotificationLink       `json:"link,omitempty"`
 	Markdown    *DingTalkNotificationMarkdown   `json:"markdown,omitempty"`
 	ActionCard  *DingTalkNotificationActionCard `json:"actionCard,omitempty"`
+	FeedCard    *DingTalkNotificationFeedCard   `json:"feedCard,omitempty"`
 	At          *DingTalkNotificationAt         `json:"at,omitempty"`
 }
 
@@ -33,6 +43,7 @@ type DingTalkNotificationMarkdown struct {
 
 type DingTalkNotificationAt struct {
 	AtMobiles []string `json:"atMobiles,omitempty"`
+	AtUserIds []string `json:"atUserIds,omitempty"`
 	IsAtAll   bool     `json:"isAtAll,omitempty"`
 }
 
@@ -50,3 +61,13 @@ type DingTalkNotificationButton struct {
 	Title     string `json:"title"`
 	ActionURL string `json:"actionURL"`
 }
+
+type DingTalkNotificationFeedCard struct {
+	Links []DingTalkNotificationFeedCardLink `json:"links"`
+}
+
+type DingTalkNotificationFeedCardLink struct {
+	Title      string `json:"title"`
+	MessageURL string `json:"messageURL"`
+	PictureURL string `json:"picURL"`
+}
@@ -106,6 +106,7 @@ type Data struct {
 	Receiver string `json:"receiver"`
 	Status   string `json:"status"`
 	Alerts   Alerts `json:"alerts"`
+	GroupKey string `json:"groupKey"`
 
 	GroupLabels       KV `json:"groupLabels"`
 	CommonLabels      KV `json:"commonLabels"`
@@ -113,6 +114,36 @@ type Data struct {
 
 	ExternalURL string `json:"externalURL"`
 	AtMobiles   []string
+	AtUserIds   []string
+
+	// Raw is the payload the data was decoded from, unmarshaled as generic
+	// JSON, so that templates can use what was not normalized.
+	Raw interface{} `json:"-"`
+}
+
+// AlertData is the data passed to notification templates when the alerts of a
+// group are notified one by one. It looks like a group holding the single
+// alert, so that templates written for groups keep working, while the alert
+// itself and the whole group are available as Alert and Group.
+type AlertData struct {
+	Data
+
+	Alert Alert
+	Group *Data
+}
+
+// NewAlertData returns the template data for notifying the alert of the group on its own.
+func NewAlertData(group *Data, alert Alert) *AlertData {
+	d := &AlertData{
+		Data:  *group,
+		Alert: alert,
+		Group: group,
+	}
+	d.Status = alert.Status
+	d.Alerts = Alerts{alert}
+	d.AtMobiles = append([]string(nil), group.AtMobiles...)
+	d.AtUserIds = append([]string(nil), group.AtUserIds...)
+	return d
 }
 
 // Alert holds one alert for notification templates.
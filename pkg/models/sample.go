@@ -0,0 +1,69 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// NewSampleWebhookMessage returns a realistic Alertmanager notification with
+// alerts in the given status ("firing" or "resolved"), for trying out
+// templates and targets. The alerts started at now minus five minutes, and
+// resolved ones ended at now. Its raw payload is its own JSON, as posted by
+// Alertmanager.
+func NewSampleWebhookMessage(status string, now time.Time) *WebhookMessage {
+	startsAt := now.Add(-5 * time.Minute)
+	var endsAt time.Time
+	if status == string(model.AlertResolved) {
+		endsAt = now
+	}
+
+	alert := func(instance, fingerprint string) Alert {
+		return Alert{
+			Status: status,
+			Labels: KV{
+				"alertname": "InstanceDown",
+				"instance":  instance,
+				"job":       "node",
+				"severity":  "critical",
+			},
+			Annotations: KV{
+				"summary":     "Instance " + instance + " down",
+				"description": instance + " of job node has been down for more than 5 minutes.",
+			},
+			StartsAt:     startsAt,
+			EndsAt:       endsAt,
+			GeneratorURL: "http://prometheus.example.com/graph?g0.expr=up+%3D%3D+0",
+			Fingerprint:  fingerprint,
+		}
+	}
+
+	m := &WebhookMessage{
+		Receiver: "dingtalk",
+		Status:   status,
+		Alerts: Alerts{
+			alert("server01.example.com:9100", "4f5c1b2a3d6e7f80"),
+			alert("server02.example.com:9100", "9a8b7c6d5e4f3a21"),
+		},
+		GroupKey: `{}:{alertname="InstanceDown"}`,
+		GroupLabels: KV{
+			"alertname": "InstanceDown",
+		},
+		CommonLabels: KV{
+			"alertname": "InstanceDown",
+			"job":       "node",
+			"severity":  "critical",
+		},
+		CommonAnnotations: KV{},
+		ExternalURL:       "http://alertmanager.example.com",
+	}
+
+	if b, err := json.Marshal(m); err == nil {
+		var raw interface{}
+		if json.Unmarshal(b, &raw) == nil {
+			m.Raw = raw
+		}
+	}
+	return m
+}
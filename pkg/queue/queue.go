@@ -0,0 +1,427 @@
+// Package queue implements a durable FIFO queue backed by append-only
+// segment files on disk.
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultSegmentSize is the size after which a new segment file is started.
+	DefaultSegmentSize = 8 << 20
+
+	segmentSuffix  = ".seg"
+	corruptSuffix  = ".corrupt"
+	cursorFilename = "cursor"
+	headerSize     = 8
+	maxRecordSize  = 64 << 20
+)
+
+// ErrEmpty is returned by Peek when there are no pending records.
+var ErrEmpty = errors.New("queue is empty")
+
+// CorruptionError is returned by Peek when the segment holding the next
+// record is corrupted. The segment has been set aside by then, so that the
+// following call to Peek goes on with the next segment.
+type CorruptionError struct {
+	// Path is where the corrupted segment was moved to.
+	Path string
+	Err  error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted queue segment moved to %s: %s", e.Path, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Queue is a durable FIFO queue. Records are appended to segment files and
+// consumed in order; a cursor file tracks the position of the first
+// unacknowledged record so that pending records survive restarts.
+//
+// Each record is stored as a 4-byte big-endian length, a 4-byte CRC32
+// (Castagnoli) checksum and the payload.
+type Queue struct {
+	dir         string
+	segmentSize int64
+
+	mtx      sync.Mutex
+	segments []uint64
+	writer   *os.File
+	writeOff int64
+	readOff  int64
+	peekOff  int64
+	length   int
+	notify   chan struct{}
+}
+
+// Open opens (or creates) the queue stored in dir.
+func Open(dir string, segmentSize int64) (*Queue, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		dir:         dir,
+		segmentSize: segmentSize,
+		notify:      make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, seq)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	cursorSeg, cursorOff, err := q.readCursor()
+	if err != nil {
+		return err
+	}
+	// Drop segments which have been consumed completely.
+	for len(q.segments) > 0 && q.segments[0] < cursorSeg {
+		if err := os.Remove(q.segmentPath(q.segments[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) > 0 && q.segments[0] == cursorSeg {
+		q.readOff = cursorOff
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = []uint64{cursorSeg}
+	}
+
+	// Count pending records, truncating a torn write at the tail of the last
+	// segment if there is one.
+	for i, seq := range q.segments {
+		var start int64
+		if i == 0 {
+			start = q.readOff
+		}
+		n, validEnd, err := q.scanSegment(seq, start)
+		if err != nil {
+			return err
+		}
+		q.length += n
+
+		if i == len(q.segments)-1 {
+			f, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY, 0o640)
+			if err != nil {
+				return err
+			}
+			if err := f.Truncate(validEnd); err != nil {
+				f.Close()
+				return err
+			}
+			if _, err := f.Seek(validEnd, io.SeekStart); err != nil {
+				f.Close()
+				return err
+			}
+			q.writer = f
+			q.writeOff = validEnd
+		}
+	}
+	q.peekOff = q.readOff
+	return nil
+}
+
+// scanSegment counts the valid records in the segment starting at offset and
+// returns the offset right after the last valid record.
+func (q *Queue) scanSegment(seq uint64, offset int64) (int, int64, error) {
+	f, err := os.Open(q.segmentPath(seq))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	for {
+		_, next, err := readRecord(f, offset)
+		if err != nil {
+			return n, offset, nil
+		}
+		n++
+		offset = next
+	}
+}
+
+// Enqueue durably appends a record to the queue.
+func (q *Queue) Enqueue(data []byte) error {
+	if len(data) > maxRecordSize {
+		return fmt.Errorf("record too large: %d bytes", len(data))
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.writer == nil {
+		return errors.New("queue is closed")
+	}
+
+	if q.writeOff >= q.segmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[headerSize:], data)
+
+	if _, err := q.writer.Write(buf); err != nil {
+		return q.rollback(err)
+	}
+	if err := q.writer.Sync(); err != nil {
+		return q.rollback(err)
+	}
+	q.writeOff += int64(len(buf))
+	q.length++
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rollback truncates the segment being written back to the end of the last
+// complete record after a failed write, so that no torn record is left
+// behind. The caller must hold q.mtx.
+func (q *Queue) rollback(err error) error {
+	if terr := q.writer.Truncate(q.writeOff); terr != nil {
+		return fmt.Errorf("%w (truncating torn record: %s)", err, terr)
+	}
+	if _, serr := q.writer.Seek(q.writeOff, io.SeekStart); serr != nil {
+		return fmt.Errorf("%w (seeking after torn record: %s)", err, serr)
+	}
+	return err
+}
+
+func (q *Queue) rotate() error {
+	if err := q.writer.Close(); err != nil {
+		return err
+	}
+	seq := q.segments[len(q.segments)-1] + 1
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	q.writer = f
+	q.writeOff = 0
+	q.segments = append(q.segments, seq)
+	return nil
+}
+
+// Peek returns the first unacknowledged record without removing it. It
+// returns ErrEmpty if there is none.
+func (q *Queue) Peek() ([]byte, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for {
+		if q.length == 0 {
+			return nil, ErrEmpty
+		}
+
+		seq := q.segments[0]
+		f, err := os.Open(q.segmentPath(seq))
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if q.readOff >= fi.Size() && len(q.segments) > 1 {
+			// End of the segment: move on to the next one.
+			f.Close()
+			if err := q.advanceSegment(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		data, next, err := readRecord(f, q.readOff)
+		f.Close()
+		if err == nil {
+			q.peekOff = next
+			return data, nil
+		}
+		return nil, q.quarantine(err)
+	}
+}
+
+// quarantine sets the segment at the head of the queue aside after failing
+// to read a record from it, and recounts the pending records. The caller
+// must hold q.mtx.
+func (q *Queue) quarantine(cause error) error {
+	seq := q.segments[0]
+	if len(q.segments) == 1 {
+		// Keep writing to a fresh segment.
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	path := q.segmentPath(seq) + corruptSuffix
+	if err := os.Rename(q.segmentPath(seq), path); err != nil {
+		return err
+	}
+	q.segments = q.segments[1:]
+	q.readOff = 0
+	q.peekOff = 0
+	if err := q.writeCursor(q.segments[0], 0); err != nil {
+		return err
+	}
+
+	q.length = 0
+	for _, seq := range q.segments {
+		n, _, err := q.scanSegment(seq, 0)
+		if err != nil {
+			return err
+		}
+		q.length += n
+	}
+	return &CorruptionError{Path: path, Err: cause}
+}
+
+// Ack removes the record returned by the last call to Peek.
+func (q *Queue) Ack() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.peekOff == q.readOff {
+		return nil
+	}
+	q.readOff = q.peekOff
+	q.length--
+	return q.writeCursor(q.segments[0], q.readOff)
+}
+
+func (q *Queue) advanceSegment() error {
+	old := q.segments[0]
+	q.segments = q.segments[1:]
+	q.readOff = 0
+	q.peekOff = 0
+	if err := q.writeCursor(q.segments[0], 0); err != nil {
+		return err
+	}
+	return os.Remove(q.segmentPath(old))
+}
+
+// Len returns the number of pending records.
+func (q *Queue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.length
+}
+
+// Notify returns a channel which receives a value whenever a record is enqueued.
+func (q *Queue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// Close closes the queue.
+func (q *Queue) Close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.writer == nil {
+		return nil
+	}
+	err := q.writer.Close()
+	q.writer = nil
+	return err
+}
+
+func (q *Queue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+func (q *Queue) readCursor() (uint64, int64, error) {
+	b, err := os.ReadFile(filepath.Join(q.dir, cursorFilename))
+	if os.IsNotExist(err) {
+		if len(q.segments) > 0 {
+			return q.segments[0], 0, nil
+		}
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(b) != 16 {
+		return 0, 0, fmt.Errorf("corrupted queue cursor in %s", q.dir)
+	}
+	return binary.BigEndian.Uint64(b[0:8]), int64(binary.BigEndian.Uint64(b[8:16])), nil
+}
+
+func (q *Queue) writeCursor(seq uint64, offset int64) error {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], seq)
+	binary.BigEndian.PutUint64(b[8:16], uint64(offset))
+
+	tmp := filepath.Join(q.dir, cursorFilename+".tmp")
+	if err := os.WriteFile(tmp, b[:], 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, cursorFilename))
+}
+
+func readRecord(r io.ReaderAt, offset int64) ([]byte, int64, error) {
+	var header [headerSize]byte
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, 0, fmt.Errorf("invalid record size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, offset+headerSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	return data, offset + headerSize + int64(size), nil
+}
@@ -0,0 +1,237 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustOpen(t *testing.T, dir string, segmentSize int64) *Queue {
+	t.Helper()
+	q, err := Open(dir, segmentSize)
+	if err != nil {
+		t.Fatalf("opening queue: %s", err)
+	}
+	return q
+}
+
+func mustEnqueue(t *testing.T, q *Queue, records ...string) {
+	t.Helper()
+	for _, r := range records {
+		if err := q.Enqueue([]byte(r)); err != nil {
+			t.Fatalf("enqueuing %q: %s", r, err)
+		}
+	}
+}
+
+// drain consumes the queue until it is empty, skipping corrupted segments.
+func drain(t *testing.T, q *Queue) (records []string, corruptions int) {
+	t.Helper()
+	for {
+		b, err := q.Peek()
+		var corruptErr *CorruptionError
+		switch {
+		case errors.Is(err, ErrEmpty):
+			return records, corruptions
+		case errors.As(err, &corruptErr):
+			corruptions++
+			if corruptions > 10 {
+				t.Fatalf("too many corruptions: %s", err)
+			}
+			continue
+		case err != nil:
+			t.Fatalf("peeking: %s", err)
+		}
+		records = append(records, string(b))
+		if err := q.Ack(); err != nil {
+			t.Fatalf("acknowledging: %s", err)
+		}
+	}
+}
+
+func assertRecords(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got records %q, want %q", got, want)
+	}
+}
+
+func segmentFiles(t *testing.T, dir, suffix string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestQueueRotation(t *testing.T) {
+	dir := t.TempDir()
+	q := mustOpen(t, dir, 32)
+	defer q.Close()
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		r := fmt.Sprintf("record-%02d", i)
+		mustEnqueue(t, q, r)
+		want = append(want, r)
+	}
+	if n := len(segmentFiles(t, dir, segmentSuffix)); n < 3 {
+		t.Fatalf("expected the queue to rotate over several segments, got %d", n)
+	}
+	if q.Len() != len(want) {
+		t.Fatalf("got length %d, want %d", q.Len(), len(want))
+	}
+
+	got, corruptions := drain(t, q)
+	assertRecords(t, got, want...)
+	if corruptions != 0 {
+		t.Fatalf("got %d corruptions, want none", corruptions)
+	}
+	if n := len(segmentFiles(t, dir, segmentSuffix)); n != 1 {
+		t.Fatalf("expected consumed segments to be removed, got %d segments", n)
+	}
+}
+
+func TestQueueRestartRecovery(t *testing.T) {
+	dir := t.TempDir()
+	q := mustOpen(t, dir, 32)
+	mustEnqueue(t, q, "a-record", "b-record", "c-record", "d-record")
+
+	// Consume the first record, and peek at the second one without
+	// acknowledging it.
+	if _, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = mustOpen(t, dir, 32)
+	if q.Len() != 3 {
+		t.Fatalf("got length %d after restart, want 3", q.Len())
+	}
+	mustEnqueue(t, q, "e-record")
+	got, _ := drain(t, q)
+	assertRecords(t, got, "b-record", "c-record", "d-record", "e-record")
+	q.Close()
+
+	q = mustOpen(t, dir, 32)
+	defer q.Close()
+	if q.Len() != 0 {
+		t.Fatalf("got length %d after draining and restarting, want 0", q.Len())
+	}
+}
+
+func TestQueueTornTailIsTruncatedOnRestart(t *testing.T) {
+	dir := t.TempDir()
+	q := mustOpen(t, dir, DefaultSegmentSize)
+	mustEnqueue(t, q, "first", "second")
+	q.Close()
+
+	// Simulate a crash in the middle of appending a record.
+	segments := segmentFiles(t, dir, segmentSuffix)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 42, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	q = mustOpen(t, dir, DefaultSegmentSize)
+	defer q.Close()
+	if q.Len() != 2 {
+		t.Fatalf("got length %d, want 2", q.Len())
+	}
+	mustEnqueue(t, q, "third")
+	got, corruptions := drain(t, q)
+	assertRecords(t, got, "first", "second", "third")
+	if corruptions != 0 {
+		t.Fatalf("got %d corruptions, want none", corruptions)
+	}
+}
+
+func TestQueueCorruptedHeadOfOnlySegment(t *testing.T) {
+	dir := t.TempDir()
+	q := mustOpen(t, dir, DefaultSegmentSize)
+	defer q.Close()
+	mustEnqueue(t, q, "first", "second")
+
+	// Flip a byte of the payload of the first record.
+	corrupt(t, segmentFiles(t, dir, segmentSuffix)[0], headerSize)
+
+	_, err := q.Peek()
+	var corruptErr *CorruptionError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("expected a corruption error, got %v", err)
+	}
+	if _, err := os.Stat(corruptErr.Path); err != nil {
+		t.Fatalf("expected the corrupted segment to be kept aside: %s", err)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("got length %d after quarantine, want 0", q.Len())
+	}
+
+	// The queue is not stuck: new records go through.
+	mustEnqueue(t, q, "third")
+	got, _ := drain(t, q)
+	assertRecords(t, got, "third")
+}
+
+func TestQueueCorruptedOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	q := mustOpen(t, dir, 32)
+	mustEnqueue(t, q, "a-record", "b-record", "c-record", "d-record", "e-record", "f-record")
+	q.Close()
+
+	segments := segmentFiles(t, dir, segmentSuffix)
+	if len(segments) < 3 {
+		t.Fatalf("expected several segments, got %d", len(segments))
+	}
+	// Corrupt the second segment, which holds neither the head nor the tail.
+	corrupt(t, segments[1], headerSize)
+
+	q = mustOpen(t, dir, 32)
+	defer q.Close()
+	got, corruptions := drain(t, q)
+	if corruptions != 1 {
+		t.Fatalf("got %d corruptions, want 1", corruptions)
+	}
+	if len(got) == 0 || got[0] != "a-record" || got[len(got)-1] != "f-record" {
+		t.Fatalf("expected the records around the corrupted segment, got %q", got)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("got length %d after draining, want 0", q.Len())
+	}
+	if n := len(segmentFiles(t, dir, corruptSuffix)); n != 1 {
+		t.Fatalf("got %d quarantined segments, want 1", n)
+	}
+}
+
+func corrupt(t *testing.T, path string, offset int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b[:], offset); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,126 @@
+// Package ratelimit implements a token bucket rate limiter.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLimitExceeded is returned by Wait when no token becomes available within
+// the allowed waiting time.
+var ErrLimitExceeded = errors.New("rate limit exceeded")
+
+// TokenBucket allows up to limit events per interval, with bursts of up to
+// limit events.
+type TokenBucket struct {
+	mtx      sync.Mutex
+	capacity float64
+	perToken time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+// NewTokenBucket returns a full bucket allowing limit events per interval.
+func NewTokenBucket(limit int, interval time.Duration) *TokenBucket {
+	b := &TokenBucket{
+		tokens: float64(limit),
+		last:   time.Now(),
+	}
+	b.setLimit(limit, interval)
+	return b
+}
+
+// SetLimit changes the rate of the bucket, keeping the tokens already
+// accumulated (up to the new capacity).
+func (b *TokenBucket) SetLimit(limit int, interval time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.advance(time.Now())
+	b.setLimit(limit, interval)
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+func (b *TokenBucket) setLimit(limit int, interval time.Duration) {
+	b.capacity = float64(limit)
+	b.perToken = interval / time.Duration(limit)
+}
+
+func (b *TokenBucket) advance(now time.Time) {
+	elapsed := now.Sub(b.last)
+	b.last = now
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += float64(elapsed) / float64(b.perToken)
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+// delay returns how long to wait until a token is available. The caller must
+// hold b.mtx.
+func (b *TokenBucket) delay() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(b.perToken))
+}
+
+// Allow takes a token if one is available right now.
+func (b *TokenBucket) Allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.advance(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Delay returns how long it takes until a token is available.
+func (b *TokenBucket) Delay() time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.advance(time.Now())
+	return b.delay()
+}
+
+// Wait blocks until a token is available and takes it. If maxWait is positive
+// and the token would not be available within maxWait, ErrLimitExceeded is
+// returned immediately without taking a token.
+func (b *TokenBucket) Wait(ctx context.Context, maxWait time.Duration) error {
+	b.mtx.Lock()
+	b.advance(time.Now())
+	d := b.delay()
+	if maxWait > 0 && d > maxWait {
+		b.mtx.Unlock()
+		return ErrLimitExceeded
+	}
+	// Reserve the token now so that concurrent waiters queue up behind us.
+	b.tokens--
+	b.mtx.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mtx.Lock()
+		b.tokens++
+		b.mtx.Unlock()
+		return ctx.Err()
+	}
+}
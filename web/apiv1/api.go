@@ -14,9 +14,14 @@
 package apiv1
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -25,33 +30,55 @@ import (
 
 	"github.com/timonwong/prometheus-webhook-dingtalk/config"
 	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
-	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/decoder"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
 	"github.com/timonwong/prometheus-webhook-dingtalk/template"
 )
 
 type API struct {
-	logger      log.Logger
-	config      func() *config.Config
-	tmpl        func() *template.Template
-	flagsMap    map[string]string
-	versionInfo *VersionInfo
-	runtimeInfo func() (*RuntimeInfo, error)
+	logger        log.Logger
+	config        func() *config.Config
+	tmpl          func() *template.Template
+	flagsMap      map[string]string
+	enableAdmin   bool
+	versionInfo   *VersionInfo
+	runtimeInfo   func() (*RuntimeInfo, error)
+	reloadHistory func() []config.ReloadEvent
+	targetStatus  func() []TargetStatus
+	sendTest      func(ctx context.Context, name string) ([]notifier.TestResult, error)
+	notifications func(q history.Query) ([]*history.Entry, error)
+	resend        func(ctx context.Context, id uint64) (*history.ResendResult, error)
+	replay        func(ctx context.Context, target string, start, end time.Time) ([]history.ResendResult, error)
 }
 
 func NewAPI(logger log.Logger,
 	config func() *config.Config,
 	tmpl func() *template.Template,
 	flagsMap map[string]string,
+	enableAdmin bool,
 	versionInfo *VersionInfo,
 	runtimeInfo func() (*RuntimeInfo, error),
+	reloadHistory func() []config.ReloadEvent,
+	targetStatus func() []TargetStatus,
+	sendTest func(ctx context.Context, name string) ([]notifier.TestResult, error),
+	notifications func(q history.Query) ([]*history.Entry, error),
+	resend func(ctx context.Context, id uint64) (*history.ResendResult, error),
+	replay func(ctx context.Context, target string, start, end time.Time) ([]history.ResendResult, error),
 ) *API {
 	return &API{
-		logger:      logger,
-		config:      config,
-		tmpl:        tmpl,
-		flagsMap:    flagsMap,
-		versionInfo: versionInfo,
-		runtimeInfo: runtimeInfo,
+		logger:        logger,
+		config:        config,
+		tmpl:          tmpl,
+		flagsMap:      flagsMap,
+		enableAdmin:   enableAdmin,
+		versionInfo:   versionInfo,
+		runtimeInfo:   runtimeInfo,
+		reloadHistory: reloadHistory,
+		targetStatus:  targetStatus,
+		sendTest:      sendTest,
+		notifications: notifications,
+		resend:        resend,
+		replay:        replay,
 	}
 }
 
@@ -76,8 +103,14 @@ func (api *API) Routes() chi.Router {
 	router.Post("/status/templates/render", wrap(api.serveRenderTemplate))
 	router.Get("/status/config", wrap(api.serveConfig))
 	router.Get("/status/runtimeinfo", wrap(api.serveRuntimeInfo))
+	router.Get("/status/reloads", wrap(api.serveReloads))
+	router.Get("/status/targets", wrap(api.serveTargetStatus))
 	router.Get("/status/buildinfo", wrap(api.serveBuildInfo))
 	router.Get("/status/flags", wrap(api.serveFlags))
+	router.Post("/targets/{name}/test", wrap(api.admin(api.serveTestTarget)))
+	router.Get("/notifications", wrap(api.serveNotifications))
+	router.Post("/notifications/replay", wrap(api.admin(api.serveReplayNotifications)))
+	router.Post("/notifications/{id}/resend", wrap(api.admin(api.serveResendNotification)))
 	return router
 }
 
@@ -97,6 +130,8 @@ const (
 	errorBadData  errorType = "bad_data"
 	errorInternal errorType = "internal"
 	errorNotFound errorType = "not_found"
+
+	errorUnavailable errorType = "unavailable"
 )
 
 type apiError struct {
@@ -167,6 +202,9 @@ func (api *API) serveRenderTemplate(r *http.Request) apiFuncResult {
 		Title         string `json:"title"`
 		Text          string `json:"text"`
 		DemoAlertJSON string `json:"demoAlertJSON"`
+		// Decoder decodes the demo alert, as Alertmanager webhook messages
+		// when empty.
+		Decoder string `json:"decoder"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -174,8 +212,7 @@ func (api *API) serveRenderTemplate(r *http.Request) apiFuncResult {
 		return apiFuncResult{nil, &apiError{errorBadData, err}}
 	}
 
-	var webhookMessage models.WebhookMessage
-	err = json.Unmarshal([]byte(req.DemoAlertJSON), &webhookMessage)
+	webhookMessage, _, err := decoder.Decode(req.Decoder, []byte(req.DemoAlertJSON))
 	if err != nil {
 		return apiFuncResult{nil, &apiError{errorBadData, err}}
 	}
@@ -188,19 +225,182 @@ func (api *API) serveRenderTemplate(r *http.Request) apiFuncResult {
 		},
 	}
 	builder := notifier.NewDingNotificationBuilder(api.tmpl(), api.config(), target)
-	notification, err := builder.Build(&webhookMessage)
+	notifications, err := builder.Build(r.Context(), webhookMessage)
 	if err != nil {
 		return apiFuncResult{nil, &apiError{errorBadData, err}}
 	}
 
+	// Messages split due to their size are previewed one after another.
+	texts := make([]string, 0, len(notifications))
+	for _, notification := range notifications {
+		texts = append(texts, notification.Markdown.Text)
+	}
 	resp := struct {
 		Markdown string `json:"markdown"`
 	}{
-		Markdown: notification.Markdown.Text,
+		Markdown: strings.Join(texts, "\n\n---\n\n"),
+	}
+	return apiFuncResult{&resp, nil}
+}
+
+func (api *API) serveTestTarget(r *http.Request) apiFuncResult {
+	name := chi.URLParam(r, "name")
+	if _, ok := api.config().Targets[name]; !ok {
+		return apiFuncResult{nil, &apiError{errorNotFound, fmt.Errorf("target %q not found", name)}}
+	}
+
+	results, err := api.sendTest(r.Context(), name)
+	if err != nil {
+		return apiFuncResult{nil, &apiError{errorExec, err}}
+	}
+
+	resp := struct {
+		Success bool                  `json:"success"`
+		Results []notifier.TestResult `json:"results"`
+	}{
+		Success: true,
+		Results: results,
+	}
+	for _, result := range results {
+		resp.Success = resp.Success && result.Success()
 	}
 	return apiFuncResult{&resp, nil}
 }
 
+// defaultNotificationsLimit is the number of notifications returned when no
+// limit is given.
+const defaultNotificationsLimit = 100
+
+func (api *API) serveNotifications(r *http.Request) apiFuncResult {
+	q := history.Query{
+		Target:      r.FormValue("target"),
+		Status:      r.FormValue("status"),
+		Fingerprint: r.FormValue("fingerprint"),
+		Search:      r.FormValue("search"),
+		Limit:       defaultNotificationsLimit,
+	}
+
+	var err error
+	if s := r.FormValue("success"); s != "" {
+		success, err := strconv.ParseBool(s)
+		if err != nil {
+			return apiFuncResult{nil, &apiError{errorBadData, fmt.Errorf("invalid parameter 'success': %w", err)}}
+		}
+		q.Success = &success
+	}
+	if s := r.FormValue("start"); s != "" {
+		if q.Start, err = parseTime(s); err != nil {
+			return apiFuncResult{nil, &apiError{errorBadData, fmt.Errorf("invalid parameter 'start': %w", err)}}
+		}
+	}
+	if s := r.FormValue("end"); s != "" {
+		if q.End, err = parseTime(s); err != nil {
+			return apiFuncResult{nil, &apiError{errorBadData, fmt.Errorf("invalid parameter 'end': %w", err)}}
+		}
+	}
+	if s := r.FormValue("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return apiFuncResult{nil, &apiError{errorBadData, fmt.Errorf("invalid parameter 'limit': must be a positive integer")}}
+		}
+	}
+
+	entries, err := api.notifications(q)
+	if err != nil {
+		return apiFuncResult{nil, historyError(err)}
+	}
+	return apiFuncResult{entries, nil}
+}
+
+// admin guards endpoints which send notifications, they are only available
+// with --web.enable-admin-api.
+func (api *API) admin(f apiFunc) apiFunc {
+	return func(r *http.Request) apiFuncResult {
+		if !api.enableAdmin {
+			return apiFuncResult{nil, &apiError{errorUnavailable, errors.New("admin APIs disabled")}}
+		}
+		return f(r)
+	}
+}
+
+func (api *API) serveResendNotification(r *http.Request) apiFuncResult {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return apiFuncResult{nil, &apiError{errorBadData, fmt.Errorf("invalid notification id: %w", err)}}
+	}
+
+	result, err := api.resend(r.Context(), id)
+	if err != nil {
+		return apiFuncResult{nil, historyError(err)}
+	}
+	return apiFuncResult{result, nil}
+}
+
+func (api *API) serveReplayNotifications(r *http.Request) apiFuncResult {
+	target := r.FormValue("target")
+	if target == "" {
+		return apiFuncResult{nil, &apiError{errorBadData, errors.New("parameter 'target' is required")}}
+	}
+	if r.FormValue("start") == "" {
+		return apiFuncResult{nil, &apiError{errorBadData, errors.New("parameter 'start' is required")}}
+	}
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		return apiFuncResult{nil, &apiError{errorBadData, fmt.Errorf("invalid parameter 'start': %w", err)}}
+	}
+	var end time.Time
+	if s := r.FormValue("end"); s != "" {
+		if end, err = parseTime(s); err != nil {
+			return apiFuncResult{nil, &apiError{errorBadData, fmt.Errorf("invalid parameter 'end': %w", err)}}
+		}
+	}
+
+	results, err := api.replay(r.Context(), target, start, end)
+	if err != nil {
+		return apiFuncResult{nil, historyError(err)}
+	}
+
+	resp := struct {
+		Success bool                   `json:"success"`
+		Results []history.ResendResult `json:"results"`
+	}{
+		Success: true,
+		Results: results,
+	}
+	for _, result := range results {
+		resp.Success = resp.Success && result.Success
+	}
+	return apiFuncResult{&resp, nil}
+}
+
+// historyError returns the API error of a failed operation on the
+// notification history.
+func historyError(err error) *apiError {
+	switch {
+	case errors.Is(err, history.ErrDisabled):
+		return &apiError{errorUnavailable, err}
+	case errors.Is(err, history.ErrNotFound), errors.Is(err, history.ErrTargetNotFound):
+		return &apiError{errorNotFound, err}
+	case errors.Is(err, context.Canceled):
+		return &apiError{errorCanceled, err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &apiError{errorTimeout, err}
+	default:
+		return &apiError{errorInternal, err}
+	}
+}
+
+// parseTime parses an RFC3339 or Unix timestamp.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, ns := math.Modf(t)
+		return time.Unix(int64(sec), int64(ns*float64(time.Second))).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
 func (api *API) serveConfig(r *http.Request) apiFuncResult {
 	cfg := &struct {
 		YAML string `json:"yaml"`
@@ -211,14 +411,14 @@ func (api *API) serveConfig(r *http.Request) apiFuncResult {
 }
 
 type RuntimeInfo struct {
-	StartTime time.Time `json:"startTime"`
-	CWD       string    `json:"CWD"`
-	// ReloadConfigSuccess bool      `json:"reloadConfigSuccess"`
-	// LastConfigTime      time.Time `json:"lastConfigTime"`
-	GoroutineCount int    `json:"goroutineCount"`
-	GOMAXPROCS     int    `json:"GOMAXPROCS"`
-	GOGC           string `json:"GOGC"`
-	GODEBUG        string `json:"GODEBUG"`
+	StartTime           time.Time `json:"startTime"`
+	CWD                 string    `json:"CWD"`
+	ReloadConfigSuccess bool      `json:"reloadConfigSuccess"`
+	LastConfigTime      time.Time `json:"lastConfigTime"`
+	GoroutineCount      int       `json:"goroutineCount"`
+	GOMAXPROCS          int       `json:"GOMAXPROCS"`
+	GOGC                string    `json:"GOGC"`
+	GODEBUG             string    `json:"GODEBUG"`
 }
 
 func (api *API) serveRuntimeInfo(r *http.Request) apiFuncResult {
@@ -230,6 +430,27 @@ func (api *API) serveRuntimeInfo(r *http.Request) apiFuncResult {
 	return apiFuncResult{status, nil}
 }
 
+func (api *API) serveReloads(r *http.Request) apiFuncResult {
+	return apiFuncResult{api.reloadHistory(), nil}
+}
+
+// TargetStatus is the health of a target, as tracked by its circuit breaker.
+type TargetStatus struct {
+	Name string `json:"name"`
+	// CircuitBreaker tells whether the circuit of the target may open at all.
+	CircuitBreaker      bool       `json:"circuitBreaker"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastErrorTime       *time.Time `json:"lastErrorTime,omitempty"`
+	LastSuccessTime     *time.Time `json:"lastSuccessTime,omitempty"`
+	RetryTime           *time.Time `json:"retryTime,omitempty"`
+}
+
+func (api *API) serveTargetStatus(r *http.Request) apiFuncResult {
+	return apiFuncResult{api.targetStatus(), nil}
+}
+
 type VersionInfo struct {
 	Version   string `json:"version"`
 	Revision  string `json:"revision"`
@@ -285,7 +506,7 @@ func (api *API) respondError(w http.ResponseWriter, apiErr *apiError, data inter
 		code = http.StatusBadRequest
 	case errorExec:
 		code = 422
-	case errorCanceled, errorTimeout:
+	case errorCanceled, errorTimeout, errorUnavailable:
 		code = http.StatusServiceUnavailable
 	case errorInternal:
 		code = http.StatusInternalServerError
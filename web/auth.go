@@ -0,0 +1,150 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-kit/log/level"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+)
+
+// maxAuthCacheSize bounds the number of cached bcrypt comparisons.
+const maxAuthCacheSize = 100
+
+// dummyHash is compared against for unknown users, so that they cannot be
+// told apart from known ones by response time.
+var dummyHash = []byte("$2a$10$Nngs/0dnKicaya3nl/kAxevT4maMPB9zXgLUckCmyTiXeYGPE.vw2")
+
+// authenticator checks the credentials of inbound requests. The outcomes of
+// bcrypt comparisons are cached since they are deliberately slow.
+type authenticator struct {
+	mtx   sync.Mutex
+	cache map[string]bool
+}
+
+func newAuthenticator() *authenticator {
+	return &authenticator{cache: map[string]bool{}}
+}
+
+// authenticate reports whether the request carries credentials accepted by
+// the auth configuration.
+func (a *authenticator) authenticate(r *http.Request, auth *config.AuthConfig) bool {
+	if user, pass, ok := r.BasicAuth(); ok {
+		return a.checkPassword(auth.BasicAuthUsers, user, pass)
+	}
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimPrefix(header, "Bearer ")
+		for _, t := range auth.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *authenticator) checkPassword(users map[string]config.Secret, user, pass string) bool {
+	hash, ok := users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pass)) // nolint: errcheck
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(user + "\x00" + string(hash) + "\x00" + pass))
+	key := hex.EncodeToString(sum[:])
+
+	a.mtx.Lock()
+	authOK, cached := a.cache[key]
+	a.mtx.Unlock()
+	if cached {
+		return authOK
+	}
+
+	authOK = bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+
+	a.mtx.Lock()
+	if len(a.cache) >= maxAuthCacheSize {
+		// Evict an arbitrary entry.
+		for k := range a.cache {
+			delete(a.cache, k)
+			break
+		}
+	}
+	a.cache[key] = authOK
+	a.mtx.Unlock()
+	return authOK
+}
+
+// checkAuth requires the users of the web configuration file for every
+// endpoint but the DingTalk webhooks, which are checked by checkTargetAuth.
+func (h *Handler) checkAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/dingtalk/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		webConfig, err := h.webConfigs.load()
+		if err != nil {
+			level.Error(h.logger).Log("msg", "Unable to load web configuration file", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if len(webConfig.Users) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.serveAuthenticated(w, r, next, &config.AuthConfig{BasicAuthUsers: webConfig.Users})
+	})
+}
+
+// checkTargetAuth requires the credentials of the target or route being posted
+// to, falling back to the users of the web configuration file.
+func (h *Handler) checkTargetAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mtx.RLock()
+		conf := h.config
+		h.mtx.RUnlock()
+
+		var auth *config.AuthConfig
+		if conf != nil {
+			auth = conf.GetAuthConfig(chi.URLParam(r, "name"))
+		}
+		if auth == nil {
+			webConfig, err := h.webConfigs.load()
+			if err != nil {
+				level.Error(h.logger).Log("msg", "Unable to load web configuration file", "err", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if len(webConfig.Users) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			auth = &config.AuthConfig{BasicAuthUsers: webConfig.Users}
+		}
+
+		h.serveAuthenticated(w, r, next, auth)
+	})
+}
+
+func (h *Handler) serveAuthenticated(w http.ResponseWriter, r *http.Request, next http.Handler, auth *config.AuthConfig) {
+	if h.auth.authenticate(r, auth) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	if len(auth.BasicAuthUsers) > 0 {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
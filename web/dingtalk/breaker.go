@@ -0,0 +1,134 @@
+package dingtalk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/circuitbreaker"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// updateBreakers creates or updates the breakers of all targets and drops
+// those of removed targets. Every target has a breaker to track its health,
+// it only opens if configured to. The caller must hold api.mtx.
+func (api *API) updateBreakers() {
+	breakers := make(map[string]*circuitbreaker.Breaker, len(api.targets))
+	for name, target := range api.targets {
+		var (
+			threshold   int
+			openTimeout time.Duration
+		)
+		if cb := api.conf.GetCircuitBreakerConfig(&target); cb != nil {
+			threshold, openTimeout = cb.FailureThreshold, cb.OpenTimeout
+		}
+
+		if b, ok := api.breakers[name]; ok {
+			b.SetLimits(threshold, openTimeout)
+			breakers[name] = b
+		} else {
+			breakers[name] = circuitbreaker.New(threshold, openTimeout)
+		}
+	}
+	api.breakers = breakers
+}
+
+func (api *API) breakerFor(name string) *circuitbreaker.Breaker {
+	api.mtx.RLock()
+	defer api.mtx.RUnlock()
+	return api.breakers[name]
+}
+
+// allow reports whether the circuit of the target lets a notification through.
+func (api *API) allow(name string) bool {
+	b := api.breakerFor(name)
+	return b == nil || b.Allow()
+}
+
+// release gives back the probe let through by allow, when the notification is
+// not sent after all.
+func (api *API) release(name string) {
+	if b := api.breakerFor(name); b != nil {
+		b.Release()
+	}
+}
+
+// recordHealth updates the breaker of the target with the outcome of a send.
+// Only transport errors, server errors and errors of the robot itself count as
+// failures: DingTalk refusing a message says nothing about the target, nor
+// does running out of the request timeout.
+func (api *API) recordHealth(ctx context.Context, logger log.Logger, name string, robotResp *models.DingTalkNotificationResponse, err error) {
+	b := api.breakerFor(name)
+	if b == nil {
+		return
+	}
+
+	var statusErr *notifier.StatusCodeError
+	switch {
+	case err == nil && !notifier.IsRobotError(robotResp.ErrorCode):
+		if b.Success() {
+			level.Info(logger).Log("msg", "Circuit breaker closed")
+		}
+	case err != nil && ctx.Err() != nil,
+		errors.As(err, &statusErr) && statusErr.StatusCode < 500:
+		b.Release()
+	default:
+		if b.Failure(failureDescription(robotResp, err)) {
+			status := b.Status()
+			level.Warn(logger).Log("msg", "Circuit breaker opened", "consecutiveFailures", status.ConsecutiveFailures, "retryTime", status.RetryTime)
+		}
+	}
+}
+
+// divert handles a notification which is not sent because the circuit of the
+// target is open. It is handed over to the fallbacks of the target, or else
+// queued until the target recovers, in which case accepted is true. It
+// returns false if neither is possible.
+func (api *API) divert(logger log.Logger, conf *config.Config, httpClients map[string]*http.Client, name string, target *config.Target, notification *models.DingTalkNotification, src history.Source) (accepted, ok bool) {
+	if api.sendToFallbacks(logger, conf, httpClients, name, target, notification, src, "circuit breaker open") {
+		return false, true
+	}
+	if api.storagePath == "" {
+		return false, false
+	}
+	if err := api.enqueue(name, notification, src); err != nil {
+		level.Error(logger).Log("msg", "Failed to enqueue notification", "err", err)
+		return false, false
+	}
+	level.Info(logger).Log("msg", "Circuit breaker open, queued notification until the target recovers")
+	return true, true
+}
+
+// TargetHealth is the health of a target, as tracked by its breaker.
+type TargetHealth struct {
+	Name string
+	// CircuitBreaker tells whether the circuit of the target may open at all.
+	CircuitBreaker bool
+	Status         circuitbreaker.Status
+}
+
+// Health returns the health of all targets, sorted by name.
+func (api *API) Health() []TargetHealth {
+	api.mtx.RLock()
+	defer api.mtx.RUnlock()
+
+	health := make([]TargetHealth, 0, len(api.breakers))
+	for name, b := range api.breakers {
+		target := api.targets[name]
+		health = append(health, TargetHealth{
+			Name:           name,
+			CircuitBreaker: api.conf.GetCircuitBreakerConfig(&target) != nil,
+			Status:         b.Status(),
+		})
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Name < health[j].Name })
+	return health
+}
@@ -0,0 +1,205 @@
+package dingtalk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+const (
+	dedupFilename = "dedup.json"
+	// dedupMaintenanceInterval is how often expired entries are dropped and
+	// the cache is persisted.
+	dedupMaintenanceInterval = time.Minute
+)
+
+// dedupCache remembers the notifications sent recently, so that identical
+// payloads, such as repeated or duplicated by Alertmanager replicas, are not
+// sent again.
+type dedupCache struct {
+	mtx     sync.Mutex
+	entries map[string]time.Time // key -> expiry
+	dirty   bool
+
+	// path is where the cache is persisted, it is kept in memory only when empty.
+	path string
+}
+
+// newDedupCache returns a cache persisted at path, loading its previous
+// content. The returned cache is usable even if loading failed.
+func newDedupCache(path string) (*dedupCache, error) {
+	c := &dedupCache{
+		entries: map[string]time.Time{},
+		path:    path,
+	}
+	if path == "" {
+		return c, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	entries := map[string]time.Time{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return c, err
+	}
+	c.entries = entries
+	c.gc(time.Now())
+	return c, nil
+}
+
+// reserve records the key for the ttl. It returns false if the key is
+// already recorded and has not expired yet.
+func (c *dedupCache) reserve(key string, ttl time.Duration) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := time.Now()
+	if expiry, ok := c.entries[key]; ok && now.Before(expiry) {
+		return false
+	}
+	c.entries[key] = now.Add(ttl)
+	c.dirty = true
+	return true
+}
+
+// release forgets the key, for instance because the notification could not
+// be delivered and has to be sent again.
+func (c *dedupCache) release(key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		c.dirty = true
+	}
+}
+
+// contains reports whether the key is recorded and has not expired yet.
+func (c *dedupCache) contains(key string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	expiry, ok := c.entries[key]
+	return ok && time.Now().Before(expiry)
+}
+
+// remember records the key for the ttl, whether it is already recorded or not.
+func (c *dedupCache) remember(key string, ttl time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.entries[key] = time.Now().Add(ttl)
+	c.dirty = true
+}
+
+func (c *dedupCache) gc(now time.Time) {
+	for key, expiry := range c.entries {
+		if !now.Before(expiry) {
+			delete(c.entries, key)
+			c.dirty = true
+		}
+	}
+}
+
+// maintain drops expired entries and persists the cache if needed.
+func (c *dedupCache) maintain() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.gc(time.Now())
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o750); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// runDedupMaintenance periodically maintains the dedup cache until the API
+// is closed, persisting it a last time on exit.
+func (api *API) runDedupMaintenance() {
+	ticker := time.NewTicker(dedupMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-api.ctx.Done():
+			if err := api.dedup.maintain(); err != nil {
+				level.Error(api.logger).Log("msg", "Failed to persist dedup cache", "err", err)
+			}
+			return
+		case <-ticker.C:
+			if err := api.dedup.maintain(); err != nil {
+				level.Error(api.logger).Log("msg", "Failed to persist dedup cache", "err", err)
+			}
+		}
+	}
+}
+
+func dedupPath(storagePath string) string {
+	if storagePath == "" {
+		return ""
+	}
+	return filepath.Join(storagePath, dedupFilename)
+}
+
+// dedupKey identifies a notification of the message to the target by the
+// group key and the fingerprints and statuses of its alerts.
+func dedupKey(target string, m *models.WebhookMessage) string {
+	alerts := make([]string, 0, len(m.Alerts))
+	for _, a := range m.Alerts {
+		fp := a.Fingerprint
+		if fp == "" {
+			// Payloads of old Alertmanager versions have no fingerprint.
+			var sb strings.Builder
+			for _, p := range a.Labels.SortedPairs() {
+				sb.WriteString(p.Name)
+				sb.WriteByte('=')
+				sb.WriteString(p.Value)
+				sb.WriteByte(',')
+			}
+			fp = sb.String()
+		}
+		alerts = append(alerts, fp+":"+a.Status)
+	}
+	sort.Strings(alerts)
+
+	h := sha256.New()
+	h.Write([]byte(target))
+	h.Write([]byte{0})
+	h.Write([]byte(m.GroupKey))
+	for _, a := range alerts {
+		h.Write([]byte{0})
+		h.Write([]byte(a))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
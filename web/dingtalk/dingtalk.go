@@ -1,20 +1,31 @@
 package dingtalk
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/timonwong/prometheus-webhook-dingtalk/config"
 	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
 	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/chilog"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/circuitbreaker"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/decoder"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
 	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/queue"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/ratelimit"
 	"github.com/timonwong/prometheus-webhook-dingtalk/template"
 )
 
@@ -22,40 +33,182 @@ type API struct {
 	// Protect against config, template and http client
 	mtx sync.RWMutex
 
-	conf       *config.Config
-	tmpl       *template.Template
-	targets    map[string]config.Target
-	httpClient *http.Client
-	logger     log.Logger
+	conf        *config.Config
+	tmpl        *template.Template
+	targets     map[string]config.Target
+	httpClients map[string]*http.Client
+	logger      log.Logger
+
+	// storagePath is the directory of on-disk state, queueing is disabled when empty.
+	storagePath string
+	queues      map[string]*queue.Queue
+
+	// Rate limiters keyed by robot URL, they outlive configuration reloads.
+	limiters    map[string]*ratelimit.TokenBucket
+	coalesceMtx sync.Mutex
+	coalescers  map[string]*coalescer
+
+	// Circuit breakers keyed by target name, they outlive configuration reloads.
+	breakers map[string]*circuitbreaker.Breaker
+
+	dedup         *dedupCache
+	history       *history.Store
+	deadLetterMtx sync.Mutex
+	metrics       *metrics
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
-func NewAPI(logger log.Logger) *API {
-	return &API{
-		logger: logger,
+func NewAPI(logger log.Logger, storagePath string, historyOpts history.Options, reg prometheus.Registerer) *API {
+	dedup, err := newDedupCache(dedupPath(storagePath))
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to load dedup cache, starting with an empty one", "err", err)
+	}
+	historyOpts.Logger = logger
+	hist, err := openHistory(storagePath, historyOpts)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to open notification history, it is disabled", "err", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	api := &API{
+		logger:      logger,
+		storagePath: storagePath,
+		queues:      map[string]*queue.Queue{},
+		limiters:    map[string]*ratelimit.TokenBucket{},
+		coalescers:  map[string]*coalescer{},
+		dedup:       dedup,
+		history:     hist,
+		metrics:     newMetrics(reg),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	api.wg.Add(1)
+	go func() {
+		defer api.wg.Done()
+		api.runDedupMaintenance()
+	}()
+	if hist != nil {
+		api.wg.Add(1)
+		go func() {
+			defer api.wg.Done()
+			api.runHistoryMaintenance()
+		}()
 	}
+	return api
 }
 
-func (api *API) Update(conf *config.Config, tmpl *template.Template) {
+// Update applies the configuration and templates. The previous ones are kept
+// if the HTTP clients of the targets cannot be created.
+func (api *API) Update(conf *config.Config, tmpl *template.Template) error {
+	httpClients, err := newHTTPClients(conf)
+	if err != nil {
+		return err
+	}
+
 	api.mtx.Lock()
 	defer api.mtx.Unlock()
 
+	if api.conf != nil {
+		closeHTTPClients(api.httpClients, api.conf.RequestTimeout)
+	}
 	api.conf = conf
 	api.tmpl = tmpl
 	api.targets = conf.Targets
-	api.httpClient = &http.Client{
-		Transport: &http.Transport{
-			Proxy:             http.ProxyFromEnvironment,
-			DisableKeepAlives: true,
-		},
+	api.httpClients = httpClients
+
+	api.updateLimiters()
+	api.updateBreakers()
+	api.startQueueWorkers()
+	return nil
+}
+
+// newHTTPClients creates the HTTP clients of all targets.
+func newHTTPClients(conf *config.Config) (map[string]*http.Client, error) {
+	httpClients := make(map[string]*http.Client, len(conf.Targets))
+	for name, target := range conf.Targets {
+		target := target
+		httpClient, err := notifier.NewHTTPClient(conf.GetHTTPClientConfig(&target))
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", name, err)
+		}
+		httpClients[name] = httpClient
+	}
+	return httpClients, nil
+}
+
+// closeHTTPClients closes the idle connections of HTTP clients which are
+// replaced. Requests in flight may still use them, their connections are
+// closed once the request timeout elapsed.
+func closeHTTPClients(httpClients map[string]*http.Client, requestTimeout time.Duration) {
+	closeIdle := func() {
+		for _, c := range httpClients {
+			c.CloseIdleConnections()
+		}
+	}
+	closeIdle()
+	if requestTimeout > 0 {
+		time.AfterFunc(requestTimeout, closeIdle)
 	}
 }
 
-func (api *API) Routes() chi.Router {
+// startQueueWorkers starts delivery workers for targets with queueing enabled,
+// as well as for targets which still have pending notifications on disk. The
+// caller must hold api.mtx.
+func (api *API) startQueueWorkers() {
+	if api.storagePath == "" {
+		for name, target := range api.targets {
+			if target.Queue {
+				level.Warn(api.logger).Log("msg", "Queueing is enabled for target but no storage path is configured, sending synchronously", "target", name)
+			}
+		}
+		return
+	}
+
+	for name, target := range api.targets {
+		if !target.Queue {
+			if _, err := os.Stat(filepath.Join(api.storagePath, "queue", name)); err != nil {
+				continue
+			}
+		}
+		if _, err := api.queueFor(name); err != nil {
+			level.Error(api.logger).Log("msg", "Failed to open notification queue", "target", name, "err", err)
+		}
+	}
+}
+
+// Close stops the queue workers and closes the queues and the history.
+func (api *API) Close() {
+	api.cancel()
+	api.stopCoalescers()
+	api.wg.Wait()
+
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	closeHTTPClients(api.httpClients, 0)
+	for name, q := range api.queues {
+		if err := q.Close(); err != nil {
+			level.Error(api.logger).Log("msg", "Failed to close notification queue", "target", name, "err", err)
+		}
+	}
+	if api.history != nil {
+		if err := api.history.Close(); err != nil {
+			level.Error(api.logger).Log("msg", "Failed to close notification history", "err", err)
+		}
+	}
+}
+
+// Routes returns the router of the webhooks, the middlewares are applied to
+// the matched routes so that they can access the target name.
+func (api *API) Routes(middlewares ...func(http.Handler) http.Handler) chi.Router {
 	router := chi.NewRouter()
 	router.Use(middleware.RealIP)
 	router.Use(middleware.RequestLogger(&chilog.KitLogger{Logger: api.logger}))
 	router.Use(middleware.Recoverer)
-	router.Post("/{name}/send", api.serveSend)
+	router.With(middlewares...).Post("/{name}/send", api.serveSend)
 	return router
 }
 
@@ -64,46 +217,257 @@ func (api *API) serveSend(w http.ResponseWriter, r *http.Request) {
 	targets := api.targets
 	conf := api.conf
 	tmpl := api.tmpl
-	httpClient := api.httpClient
+	httpClients := api.httpClients
 	api.mtx.RUnlock()
 
-	targetName := chi.URLParam(r, "name")
-	logger := log.With(api.logger, "target", targetName)
+	name := chi.URLParam(r, "name")
 
-	target, ok := targets[targetName]
-	if !ok {
-		level.Warn(logger).Log("msg", "target not found")
+	_, isTarget := targets[name]
+	route, isRoute := conf.Routes[name]
+
+	var logger log.Logger
+	switch {
+	case isTarget:
+		logger = log.With(api.logger, "target", name)
+	case isRoute:
+		logger = log.With(api.logger, "route", name)
+	default:
+		level.Warn(api.logger).Log("msg", "target not found", "target", name)
 		http.NotFound(w, r)
 		return
 	}
+	api.metrics.webhooksReceived.WithLabelValues(name).Inc()
+
+	// Bound the whole handling of the webhook, including retries, by the
+	// request timeout, and stop as soon as the sender hangs up. Each request
+	// to DingTalk is bounded by the timeout of the HTTP client.
+	ctx := r.Context()
+	if conf.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.RequestTimeout)
+		defer cancel()
+	}
 
-	var promMessage models.WebhookMessage
-	if err := json.NewDecoder(r.Body).Decode(&promMessage); err != nil {
-		level.Error(logger).Log("msg", "Cannot decode prometheus webhook JSON request", "err", err)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		level.Error(logger).Log("msg", "Cannot read webhook request", "err", err)
+		api.metrics.notificationsFailed.WithLabelValues(name, reasonDecode).Inc()
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
-
-	builder := notifier.NewDingNotificationBuilder(tmpl, conf, &target)
-	notification, err := builder.Build(&promMessage)
+	promMessage, decoderName, err := decoder.Decode(conf.GetDecoder(name), body)
 	if err != nil {
-		level.Error(logger).Log("msg", "Failed to build notification", "err", err)
+		level.Error(logger).Log("msg", "Cannot decode webhook JSON request", "decoder", decoderName, "err", err)
+		api.metrics.notificationsFailed.WithLabelValues(name, reasonDecode).Inc()
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	level.Debug(logger).Log("msg", "Decoded webhook request", "decoder", decoderName, "alerts", len(promMessage.Alerts))
+
+	dispatches := []dispatch{{target: name, message: promMessage}}
+	if isRoute {
+		dispatches = routeMessage(route, promMessage)
+		if len(dispatches) == 0 {
+			level.Warn(logger).Log("msg", "No target matched by route")
+		}
+	}
+
+	var (
+		accepted bool
+		derr     *deliveryError
+		notified []string // redelivery keys of the routed targets notified
+	)
+	for _, d := range dispatches {
+		dlogger := logger
+		var rkey string
+		if isRoute {
+			dlogger = log.With(logger, "target", d.target)
+			rkey = redeliveryKey(d.target, d.message)
+			if api.dedup.contains(rkey) {
+				level.Info(dlogger).Log("msg", "Target already notified before the route failed, skipping", "groupKey", d.message.GroupKey)
+				notified = append(notified, rkey)
+				continue
+			}
+		}
+
+		target := targets[d.target]
+		var key string
+		if conf.Dedup != nil {
+			key = dedupKey(d.target, d.message)
+			if !api.dedup.reserve(key, conf.Dedup.TTL) {
+				level.Info(dlogger).Log("msg", "Suppressing duplicated notification", "groupKey", d.message.GroupKey)
+				continue
+			}
+		}
+
+		ok, err := api.notify(ctx, dlogger, conf, tmpl, httpClients, d.target, &target, d.message)
+		if err != nil {
+			if key != "" {
+				api.dedup.release(key)
+			}
+			// Keep going so that the other targets are notified anyway.
+			if derr == nil {
+				derr = err
+			}
+			continue
+		}
+		if rkey != "" {
+			notified = append(notified, rkey)
+		}
+		accepted = accepted || ok
+	}
+	if isRoute {
+		api.settleRedelivery(notified, derr != nil)
+	}
+
+	if derr != nil {
+		http.Error(w, derr.msg, derr.status)
+		return
+	}
+	if accepted {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "Accepted")
+		return
+	}
+	io.WriteString(w, "OK")
+}
 
-	robotResp, err := notifier.SendNotification(notification, httpClient, &target)
+// notify builds the notifications for the message and delivers them to the
+// target in order.
+func (api *API) notify(ctx context.Context, logger log.Logger, conf *config.Config, tmpl *template.Template, httpClients map[string]*http.Client, name string, target *config.Target, m *models.WebhookMessage) (accepted bool, derr *deliveryError) {
+	builder := notifier.NewDingNotificationBuilder(tmpl, conf, target)
+	start := time.Now()
+	notifications, err := builder.Build(ctx, m)
+	api.metrics.renderDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
 	if err != nil {
+		if ctx.Err() != nil {
+			api.metrics.notificationsFailed.WithLabelValues(name, failureReason(ctx, err)).Inc()
+			return false, contextError(ctx, logger, err)
+		}
+		level.Error(logger).Log("msg", "Failed to build notification", "err", err)
+		api.metrics.notificationsFailed.WithLabelValues(name, reasonTemplate).Inc()
+		return false, &deliveryError{http.StatusBadRequest, "Bad Request"}
+	}
+	api.metrics.notificationsRendered.WithLabelValues(name).Add(float64(len(notifications)))
+
+	src := history.NewSource(m)
+	for i, notification := range notifications {
+		ok, derr := api.deliver(ctx, logger, conf, httpClients, name, target, notification, src.WithDeliveryID(name, i))
+		if derr != nil {
+			return accepted, derr
+		}
+		accepted = accepted || ok
+	}
+	return accepted, nil
+}
+
+// deliveryError describes the HTTP response to reply with when a notification
+// could not be delivered.
+type deliveryError struct {
+	status int
+	msg    string
+}
+
+// statusClientClosedRequest is the non-standard status, borrowed from nginx,
+// used when the sender went away before the notification was delivered.
+const statusClientClosedRequest = 499
+
+// contextError logs a notification which timed out or was canceled and returns
+// the response to reply with: 504 on timeout, so that the sender may retry,
+// and 499 on cancellation, which nobody is waiting for anyway.
+func contextError(ctx context.Context, logger log.Logger, err error) *deliveryError {
+	if failureReason(ctx, err) == reasonCanceled {
+		level.Warn(logger).Log("msg", "Request canceled before the notification was delivered", "err", err)
+		return &deliveryError{statusClientClosedRequest, "Client Closed Request"}
+	}
+	level.Error(logger).Log("msg", "Timed out delivering notification", "err", err)
+	return &deliveryError{http.StatusGatewayTimeout, "Gateway Timeout"}
+}
+
+// deliver sends the notification to the target, or hands it over for later
+// delivery, in which case accepted is true.
+func (api *API) deliver(ctx context.Context, logger log.Logger, conf *config.Config, httpClients map[string]*http.Client, name string, target *config.Target, notification *models.DingTalkNotification, src history.Source) (accepted bool, derr *deliveryError) {
+	if target.Queue && api.storagePath != "" {
+		if err := api.enqueue(name, notification, src); err != nil {
+			level.Error(logger).Log("msg", "Failed to enqueue notification", "err", err)
+			api.metrics.notificationsFailed.WithLabelValues(name, reasonEnqueue).Inc()
+			return false, &deliveryError{http.StatusInternalServerError, "Internal Server Error"}
+		}
+		return true, nil
+	}
+
+	if !api.allow(name) {
+		level.Warn(logger).Log("msg", "Circuit breaker open, not sending notification")
+		api.metrics.notificationsFailed.WithLabelValues(name, reasonCircuit).Inc()
+		if accepted, ok := api.divert(logger, conf, httpClients, name, target, notification, src); ok {
+			return accepted, nil
+		}
+		return false, &deliveryError{http.StatusServiceUnavailable, "Circuit breaker open"}
+	}
+
+	if limiter := api.limiterFor(target); limiter != nil {
+		if target.RateLimit.Strategy == config.RateLimitStrategyCoalesce {
+			if !limiter.Allow() {
+				// Once shutting down, the notification is sent right away
+				// rather than parked.
+				if api.coalesce(name, target, limiter, notification, src) {
+					level.Info(logger).Log("msg", "Rate limit exceeded, coalescing notification")
+					api.release(name)
+					return true, nil
+				}
+				level.Info(logger).Log("msg", "Rate limit exceeded while shutting down, sending notification without coalescing")
+			}
+		} else if err := limiter.Wait(ctx, target.RateLimit.MaxDelay); err != nil {
+			api.release(name)
+			if !errors.Is(err, ratelimit.ErrLimitExceeded) {
+				api.metrics.notificationsFailed.WithLabelValues(name, failureReason(ctx, err)).Inc()
+				return false, contextError(ctx, logger, err)
+			}
+			level.Warn(logger).Log("msg", "Rate limit exceeded, rejecting notification")
+			api.metrics.notificationsFailed.WithLabelValues(name, reasonRateLimit).Inc()
+			return false, &deliveryError{http.StatusServiceUnavailable, "Rate limit exceeded"}
+		}
+	}
+
+	robotResp, err := api.send(ctx, logger, conf, httpClients[name], name, target, notification, src)
+	if err != nil {
+		// A single request timing out is a transport error like any other,
+		// only running out of the request timeout is reported as such.
+		if ctx.Err() != nil {
+			return false, contextError(ctx, logger, err)
+		}
 		level.Error(logger).Log("msg", "Failed to send notification", "err", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
+		if api.failover(logger, conf, httpClients, name, target, notification, src, failureDescription(robotResp, err)) {
+			return false, nil
+		}
+		return false, &deliveryError{http.StatusBadRequest, "Bad Request"}
 	}
 
 	if robotResp.ErrorCode != 0 {
 		level.Error(logger).Log("msg", "Failed to send notification to DingTalk", "respCode", robotResp.ErrorCode, "respMsg", robotResp.ErrorMessage)
-		http.Error(w, "Unable to talk to DingTalk", http.StatusBadRequest)
-		return
+		if api.failover(logger, conf, httpClients, name, target, notification, src, failureDescription(robotResp, err)) {
+			return false, nil
+		}
+		return false, &deliveryError{http.StatusBadRequest, "Unable to talk to DingTalk"}
 	}
 
-	io.WriteString(w, "OK")
+	return false, nil
+}
+
+// SendTest fires a synthetic alert at the named target, bypassing queueing,
+// rate limiting and deduplication.
+func (api *API) SendTest(ctx context.Context, name string) ([]notifier.TestResult, error) {
+	api.mtx.RLock()
+	target, ok := api.targets[name]
+	conf := api.conf
+	tmpl := api.tmpl
+	httpClient := api.httpClients[name]
+	api.mtx.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("target %q not found", name)
+	}
+
+	logger := log.With(api.logger, "target", name)
+	return notifier.SendTestNotifications(ctx, logger, tmpl, conf, &target, httpClient)
 }
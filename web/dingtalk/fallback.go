@@ -0,0 +1,166 @@
+package dingtalk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+const deadLetterFilename = "deadletter.jsonl"
+
+// deadLetter is a notification which could be delivered neither to its target
+// nor to any of its fallbacks.
+type deadLetter struct {
+	Time      time.Time `json:"time"`
+	Target    string    `json:"target"`
+	Fallbacks []string  `json:"fallbacks,omitempty"`
+	Reason    string    `json:"reason"`
+	history.Source
+	Notification *models.DingTalkNotification `json:"notification"`
+}
+
+// failureDescription describes why a notification was not delivered, leaving
+// out the robot URL which holds the access token.
+func failureDescription(robotResp *models.DingTalkNotificationResponse, err error) string {
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &urlErr):
+		return urlErr.Err.Error()
+	case err != nil:
+		return err.Error()
+	default:
+		return fmt.Sprintf("errcode %d: %s", robotResp.ErrorCode, robotResp.ErrorMessage)
+	}
+}
+
+// failover hands a notification which could not be delivered to the target
+// over to its fallbacks. It returns false if none accepts it, in which case
+// the notification is written to the dead-letter file.
+func (api *API) failover(logger log.Logger, conf *config.Config, httpClients map[string]*http.Client, name string, target *config.Target, notification *models.DingTalkNotification, src history.Source, reason string) bool {
+	if api.sendToFallbacks(logger, conf, httpClients, name, target, notification, src, reason) {
+		return true
+	}
+	api.deadLetter(logger, name, target, notification, src, reason)
+	return false
+}
+
+// sendToFallbacks sends the notification to the fallbacks of the target in
+// order, with a banner telling delivery failed to the target, until one of
+// them accepts it. It returns false if none does.
+func (api *API) sendToFallbacks(logger log.Logger, conf *config.Config, httpClients map[string]*http.Client, name string, target *config.Target, notification *models.DingTalkNotification, src history.Source, reason string) bool {
+	if len(target.Fallback) == 0 {
+		return false
+	}
+
+	// The retries of the target may have used up the request timeout, the
+	// fallbacks get a budget of their own.
+	ctx, cancel := api.detachedContext(conf)
+	defer cancel()
+
+	banner := notifier.WithBanner(notification, fmt.Sprintf("Delivery failed to %s: %s", name, reason))
+	for _, fallback := range target.Fallback {
+		flogger := log.With(logger, "fallback", fallback)
+		fallbackTarget, ok := conf.Targets[fallback]
+		if !ok || httpClients[fallback] == nil {
+			level.Warn(flogger).Log("msg", "Fallback target no longer exists, skipping it")
+			continue
+		}
+
+		if !api.allow(fallback) {
+			level.Warn(flogger).Log("msg", "Circuit breaker of fallback target open, skipping it")
+			continue
+		}
+		if limiter := api.limiterFor(&fallbackTarget); limiter != nil {
+			if err := limiter.Wait(ctx, 0); err != nil {
+				api.release(fallback)
+				break
+			}
+		}
+
+		robotResp, err := api.send(ctx, flogger, conf, httpClients[fallback], fallback, &fallbackTarget, banner, src)
+		switch {
+		case err != nil:
+			level.Error(flogger).Log("msg", "Failed to send notification to fallback target", "err", err)
+		case robotResp.ErrorCode != 0:
+			level.Error(flogger).Log("msg", "Failed to send notification to fallback target", "respCode", robotResp.ErrorCode, "respMsg", robotResp.ErrorMessage)
+		default:
+			level.Info(flogger).Log("msg", "Notification delivered to fallback target")
+			return true
+		}
+	}
+	return false
+}
+
+// detachedContext returns a context bounded by the request timeout, which is
+// canceled early when the API is closed, unless it already is, so that the
+// notifications saved on shutdown still get a chance.
+func (api *API) detachedContext(conf *config.Config) (context.Context, context.CancelFunc) {
+	parent := api.ctx
+	if parent.Err() != nil {
+		parent = context.Background()
+	}
+	if conf.RequestTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, conf.RequestTimeout)
+}
+
+// deadLetter counts the notification as undeliverable and writes it to the
+// dead-letter file.
+func (api *API) deadLetter(logger log.Logger, name string, target *config.Target, notification *models.DingTalkNotification, src history.Source, reason string) {
+	api.metrics.notificationsDeadLettered.WithLabelValues(name).Inc()
+	if err := api.writeDeadLetter(&deadLetter{
+		Time:         time.Now(),
+		Target:       name,
+		Fallbacks:    target.Fallback,
+		Reason:       reason,
+		Source:       src,
+		Notification: notification,
+	}); err != nil {
+		level.Error(logger).Log("msg", "Failed to write undeliverable notification to the dead-letter file", "err", err)
+	}
+}
+
+// writeDeadLetter appends the notification to the dead-letter file, it is
+// only logged when there is no storage path.
+func (api *API) writeDeadLetter(d *deadLetter) error {
+	if api.storagePath == "" {
+		level.Warn(api.logger).Log("msg", "Dropping undeliverable notification, no storage path is configured for dead letters", "target", d.Target)
+		return nil
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	api.deadLetterMtx.Lock()
+	defer api.deadLetterMtx.Unlock()
+
+	if err := os.MkdirAll(api.storagePath, 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(api.storagePath, deadLetterFilename), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
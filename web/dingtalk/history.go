@@ -0,0 +1,115 @@
+package dingtalk
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+const (
+	historyFilename = "history.db"
+	// historyMaintenanceInterval is how often entries past the retention are
+	// dropped from the history.
+	historyMaintenanceInterval = 10 * time.Minute
+)
+
+// openHistory opens the notification history under storagePath, it is
+// disabled when storagePath is empty.
+func openHistory(storagePath string, opts history.Options) (*history.Store, error) {
+	if storagePath == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(storagePath, 0o750); err != nil {
+		return nil, err
+	}
+	return history.Open(filepath.Join(storagePath, historyFilename), opts)
+}
+
+// runHistoryMaintenance periodically drops the entries past the retention
+// until the API is closed.
+func (api *API) runHistoryMaintenance() {
+	ticker := time.NewTicker(historyMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := api.history.Truncate(time.Now()); err != nil {
+			level.Error(api.logger).Log("msg", "Failed to truncate notification history", "err", err)
+		} else if n > 0 {
+			level.Debug(api.logger).Log("msg", "Truncated notification history", "dropped", n)
+		}
+
+		select {
+		case <-api.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record adds the delivery of the notification to the history, if enabled.
+func (api *API) record(name string, src history.Source, notification *models.DingTalkNotification, robotResp *models.DingTalkNotificationResponse, attempts int, start time.Time, err error) {
+	if api.history == nil {
+		return
+	}
+
+	e := &history.Entry{
+		Time:         start,
+		Target:       name,
+		Source:       src,
+		Notification: notification,
+		Response:     robotResp,
+		Latency:      time.Since(start).Seconds(),
+		Attempts:     attempts,
+	}
+	switch {
+	case err != nil:
+		e.Error = err.Error()
+	case robotResp.ErrorCode == 0:
+		e.Success = true
+	}
+	if err := api.history.Add(e); err != nil {
+		level.Error(api.logger).Log("msg", "Failed to record notification history", "target", name, "err", err)
+	}
+}
+
+// Notifications returns the notifications in the history matching q, newest first.
+func (api *API) Notifications(q history.Query) ([]*history.Entry, error) {
+	if api.history == nil {
+		return nil, history.ErrDisabled
+	}
+	return api.history.Query(q)
+}
+
+// mergeSources returns the source of a notification coalesced from several
+// ones. The group is kept only if it is the same for all of them.
+func mergeSources(sources []history.Source) history.Source {
+	if len(sources) == 0 {
+		return history.Source{}
+	}
+
+	merged := sources[0]
+	merged.Fingerprints = nil
+	seen := map[string]struct{}{}
+	for _, src := range sources {
+		if src.GroupKey != merged.GroupKey {
+			merged.GroupKey = ""
+			merged.GroupLabels = nil
+		}
+		if src.Status != merged.Status {
+			merged.Status = ""
+		}
+		for _, fp := range src.Fingerprints {
+			if _, ok := seen[fp]; ok {
+				continue
+			}
+			seen[fp] = struct{}{}
+			merged.Fingerprints = append(merged.Fingerprints, fp)
+		}
+	}
+	return merged
+}
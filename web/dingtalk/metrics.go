@@ -0,0 +1,149 @@
+package dingtalk
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+const namespace = "dingtalk"
+
+// Reasons of failed notifications.
+const (
+	reasonDecode    = "decode"
+	reasonTemplate  = "template"
+	reasonTransport = "transport"
+	reasonErrcode   = "errcode"
+	reasonRateLimit = "ratelimit"
+	reasonEnqueue   = "enqueue"
+	reasonTimeout   = "timeout"
+	reasonCanceled  = "canceled"
+	reasonCircuit   = "circuit"
+	reasonExpired   = "expired"
+)
+
+// failureReason tells whether a notification failed because the request timed
+// out, was canceled, or for another transport error. The error of ctx wins
+// since the last send attempt may have failed for another reason before ctx
+// was done.
+func failureReason(ctx context.Context, err error) string {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return reasonCanceled
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return reasonTimeout
+	default:
+		return reasonTransport
+	}
+}
+
+type metrics struct {
+	webhooksReceived          *prometheus.CounterVec
+	notificationsRendered     *prometheus.CounterVec
+	notificationsSent         *prometheus.CounterVec
+	notificationsFailed       *prometheus.CounterVec
+	responseErrors            *prometheus.CounterVec
+	notificationsDeadLettered *prometheus.CounterVec
+	renderDuration            *prometheus.HistogramVec
+	sendDuration              *prometheus.HistogramVec
+}
+
+func newMetrics(r prometheus.Registerer) *metrics {
+	m := &metrics{
+		webhooksReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhooks_received_total",
+			Help:      "The total number of webhooks received per target or route.",
+		}, []string{"target"}),
+		notificationsRendered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_rendered_total",
+			Help:      "The total number of notifications rendered.",
+		}, []string{"target"}),
+		notificationsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_sent_total",
+			Help:      "The total number of notifications successfully sent to DingTalk.",
+		}, []string{"target"}),
+		notificationsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_failed_total",
+			Help:      "The total number of failed notifications by reason.",
+		}, []string{"target", "reason"}),
+		responseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "response_errors_total",
+			Help:      "The total number of error codes returned by DingTalk.",
+		}, []string{"target", "errcode"}),
+		notificationsDeadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_dead_lettered_total",
+			Help:      "The total number of notifications which could be delivered neither to their target nor to its fallbacks.",
+		}, []string{"target"}),
+		renderDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "notification_render_duration_seconds",
+			Help:      "The latency of rendering notifications.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5},
+		}, []string{"target"}),
+		sendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "notification_send_duration_seconds",
+			Help:      "The latency of sending notifications to DingTalk, including retries.",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"target"}),
+	}
+
+	if r != nil {
+		r.MustRegister(
+			m.webhooksReceived,
+			m.notificationsRendered,
+			m.notificationsSent,
+			m.notificationsFailed,
+			m.responseErrors,
+			m.notificationsDeadLettered,
+			m.renderDuration,
+			m.sendDuration,
+		)
+	}
+	return m
+}
+
+// send sends the notification to the target with retries, recording metrics
+// and the notification history.
+func (api *API) send(ctx context.Context, logger log.Logger, conf *config.Config, httpClient *http.Client, name string, target *config.Target, notification *models.DingTalkNotification, src history.Source) (*models.DingTalkNotificationResponse, error) {
+	retry := conf.GetRetryConfig(target)
+
+	start := time.Now()
+	robotResp, attempts, err := notifier.SendNotificationWithRetry(ctx, logger, notification, httpClient, target, retry)
+	api.metrics.sendDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	api.record(name, src, notification, robotResp, attempts, start, err)
+	api.recordHealth(ctx, logger, name, robotResp, err)
+
+	switch {
+	case err != nil:
+		api.metrics.notificationsFailed.WithLabelValues(name, failureReason(ctx, err)).Inc()
+	case robotResp.ErrorCode != 0:
+		api.metrics.notificationsFailed.WithLabelValues(name, reasonErrcode).Inc()
+		api.metrics.responseErrors.WithLabelValues(name, strconv.Itoa(robotResp.ErrorCode)).Inc()
+	default:
+		api.metrics.notificationsSent.WithLabelValues(name).Inc()
+	}
+	return robotResp, err
+}
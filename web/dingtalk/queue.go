@@ -0,0 +1,188 @@
+package dingtalk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/queue"
+)
+
+// queueRetryInterval is how long a worker waits before retrying a queued
+// notification that could not be delivered.
+const queueRetryInterval = 30 * time.Second
+
+type queuedNotification struct {
+	Notification *models.DingTalkNotification `json:"notification"`
+	Source       *history.Source              `json:"source,omitempty"`
+	EnqueuedAt   time.Time                    `json:"enqueuedAt"`
+}
+
+// queueFor returns the queue of the named target, opening it and starting its
+// delivery worker on first use. The caller must hold api.mtx.
+func (api *API) queueFor(name string) (*queue.Queue, error) {
+	if q, ok := api.queues[name]; ok {
+		return q, nil
+	}
+
+	q, err := queue.Open(filepath.Join(api.storagePath, "queue", name), queue.DefaultSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	api.queues[name] = q
+
+	api.wg.Add(1)
+	go func() {
+		defer api.wg.Done()
+		api.runQueueWorker(name, q)
+	}()
+	return q, nil
+}
+
+func (api *API) enqueue(name string, notification *models.DingTalkNotification, src history.Source) error {
+	b, err := json.Marshal(&queuedNotification{
+		Notification: notification,
+		Source:       &src,
+		EnqueuedAt:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	api.mtx.Lock()
+	q, err := api.queueFor(name)
+	api.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	return q.Enqueue(b)
+}
+
+// runQueueWorker drains the queue of the named target until the API is closed.
+func (api *API) runQueueWorker(name string, q *queue.Queue) {
+	logger := log.With(api.logger, "target", name, "component", "queue")
+	for {
+		b, err := q.Peek()
+		if errors.Is(err, queue.ErrEmpty) {
+			select {
+			case <-api.ctx.Done():
+				return
+			case <-q.Notify():
+				continue
+			}
+		}
+		var corruptErr *queue.CorruptionError
+		if errors.As(err, &corruptErr) {
+			level.Error(logger).Log("msg", "Skipping corrupted queued notifications", "err", err)
+			continue
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to read queued notification", "err", err)
+			if !api.sleep(queueRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		var item queuedNotification
+		if err := json.Unmarshal(b, &item); err != nil {
+			level.Error(logger).Log("msg", "Dropping undecodable queued notification", "err", err)
+			if err := q.Ack(); err != nil {
+				level.Error(logger).Log("msg", "Failed to acknowledge queued notification", "err", err)
+			}
+			continue
+		}
+
+		if !api.deliverQueued(logger, name, &item) {
+			if !api.sleep(queueRetryInterval) {
+				return
+			}
+			continue
+		}
+		if err := q.Ack(); err != nil {
+			level.Error(logger).Log("msg", "Failed to acknowledge queued notification", "err", err)
+		}
+	}
+}
+
+// deliverQueued sends a queued notification. It returns false if delivery
+// should be attempted again later.
+func (api *API) deliverQueued(logger log.Logger, name string, item *queuedNotification) bool {
+	api.mtx.RLock()
+	target, ok := api.targets[name]
+	conf := api.conf
+	httpClients := api.httpClients
+	api.mtx.RUnlock()
+
+	// Notifications queued by older versions have no source.
+	var src history.Source
+	if item.Source != nil {
+		src = *item.Source
+	}
+
+	if !ok {
+		level.Warn(logger).Log("msg", "Target of queued notification no longer exists")
+		api.deadLetter(logger, name, &config.Target{}, item.Notification, src, "target no longer exists")
+		return true
+	}
+
+	// Transport errors and an open circuit keep the notification at the head
+	// of the queue, until it is too old to be worth sending.
+	if age := time.Since(item.EnqueuedAt); age > target.GetQueueMaxAge() {
+		level.Error(logger).Log("msg", "Giving up on queued notification", "age", age)
+		api.metrics.notificationsFailed.WithLabelValues(name, reasonExpired).Inc()
+		api.failover(logger, conf, httpClients, name, &target, item.Notification, src, fmt.Sprintf("still undelivered after %s", age.Round(time.Second)))
+		return true
+	}
+
+	if !api.allow(name) {
+		// Kept in the queue until the circuit lets a probe through.
+		level.Debug(logger).Log("msg", "Circuit breaker open, will retry queued notification later")
+		return false
+	}
+
+	if limiter := api.limiterFor(&target); limiter != nil {
+		if err := limiter.Wait(api.ctx, 0); err != nil {
+			api.release(name)
+			return false
+		}
+	}
+
+	robotResp, err := api.send(api.ctx, logger, conf, httpClients[name], name, &target, item.Notification, src)
+	if err != nil {
+		if api.ctx.Err() == nil {
+			level.Error(logger).Log("msg", "Failed to send queued notification", "err", err)
+		}
+		return false
+	}
+
+	if robotResp.ErrorCode != 0 {
+		// DingTalk refused the message, retrying it will not help.
+		level.Error(logger).Log("msg", "Queued notification rejected by DingTalk", "respCode", robotResp.ErrorCode, "respMsg", robotResp.ErrorMessage)
+		api.failover(logger, conf, httpClients, name, &target, item.Notification, src, failureDescription(robotResp, nil))
+		return true
+	}
+
+	level.Debug(logger).Log("msg", "Queued notification delivered", "delay", time.Since(item.EnqueuedAt))
+	return true
+}
+
+// sleep waits for d, returning false if the API is closed in the meantime.
+func (api *API) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-api.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
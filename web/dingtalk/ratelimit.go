@@ -0,0 +1,235 @@
+package dingtalk
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/notifier"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/ratelimit"
+)
+
+// coalescer holds notifications of a target which exceeded the rate limit of
+// its robot URL until they can be sent as one message.
+type coalescer struct {
+	target  string
+	pending []*models.DingTalkNotification
+	sources []history.Source
+	timer   *time.Timer
+}
+
+// limiterKey returns the key of the rate limiter of target. Limiters are keyed by
+// robot URL since DingTalk enforces the limit per webhook.
+func limiterKey(target *config.Target) string {
+	return target.URL.String()
+}
+
+// updateLimiters creates or updates the limiters of all rate limited targets
+// and drops those no longer in use. The caller must hold api.mtx.
+func (api *API) updateLimiters() {
+	keep := map[string]struct{}{}
+	for _, target := range api.targets {
+		rl := target.RateLimit
+		if rl == nil {
+			continue
+		}
+
+		key := limiterKey(&target)
+		keep[key] = struct{}{}
+		if l, ok := api.limiters[key]; ok {
+			l.SetLimit(rl.Limit, rl.Interval)
+		} else {
+			api.limiters[key] = ratelimit.NewTokenBucket(rl.Limit, rl.Interval)
+		}
+	}
+
+	for key := range api.limiters {
+		if _, ok := keep[key]; !ok {
+			delete(api.limiters, key)
+		}
+	}
+}
+
+func (api *API) limiterFor(target *config.Target) *ratelimit.TokenBucket {
+	if target.RateLimit == nil {
+		return nil
+	}
+
+	api.mtx.RLock()
+	defer api.mtx.RUnlock()
+	return api.limiters[limiterKey(target)]
+}
+
+// coalesce parks the notification until the limiter of the target allows
+// sending, merging it with other notifications parked for the same target in
+// the meantime. Targets sharing a robot URL share the limiter, but not the
+// coalescer since their secrets and settings may differ. It returns false,
+// leaving the notification to the caller, once the API is closed.
+func (api *API) coalesce(name string, target *config.Target, limiter *ratelimit.TokenBucket, notification *models.DingTalkNotification, src history.Source) bool {
+	api.coalesceMtx.Lock()
+	defer api.coalesceMtx.Unlock()
+
+	// Close cancels the context before stopping the coalescers under the
+	// lock, so no flush can be scheduled once it waits for them.
+	if api.ctx.Err() != nil {
+		return false
+	}
+
+	c, ok := api.coalescers[name]
+	if !ok {
+		c = &coalescer{target: name}
+		api.coalescers[name] = c
+	}
+	c.pending = append(c.pending, notification)
+	c.sources = append(c.sources, src)
+	if c.timer == nil {
+		api.wg.Add(1)
+		c.timer = time.AfterFunc(limiter.Delay(), func() {
+			api.flushCoalesced(name, limiter)
+		})
+	}
+	return true
+}
+
+func (api *API) flushCoalesced(name string, limiter *ratelimit.TokenBucket) {
+	defer api.wg.Done()
+
+	api.coalesceMtx.Lock()
+	c := api.coalescers[name]
+	delete(api.coalescers, name)
+	api.coalesceMtx.Unlock()
+
+	if c == nil {
+		return
+	}
+	if api.ctx.Err() != nil {
+		api.saveCoalesced(c)
+		return
+	}
+	api.sendCoalesced(api.ctx, c, limiter)
+}
+
+// sendCoalesced sends the notifications held by c merged into as few messages
+// as possible, waiting for the limiter if any. The messages not sent yet when
+// ctx is done are queued if possible.
+func (api *API) sendCoalesced(ctx context.Context, c *coalescer, limiter *ratelimit.TokenBucket) {
+	api.mtx.RLock()
+	target, ok := api.targets[c.target]
+	conf := api.conf
+	httpClients := api.httpClients
+	api.mtx.RUnlock()
+
+	logger := log.With(api.logger, "target", c.target)
+	if !ok {
+		level.Warn(logger).Log("msg", "Target no longer exists, dropping coalesced notifications", "count", len(c.pending))
+		return
+	}
+
+	level.Info(logger).Log("msg", "Sending coalesced notifications", "count", len(c.pending))
+	merged := mergeSources(c.sources)
+	notifications := notifier.Coalesce(c.pending, conf.GetSizeLimitConfig(&target))
+	for i, notification := range notifications {
+		src := merged.WithDeliveryID(c.target, i)
+		if !api.allow(c.target) {
+			level.Warn(logger).Log("msg", "Circuit breaker open, not sending coalesced notification")
+			api.metrics.notificationsFailed.WithLabelValues(c.target, reasonCircuit).Inc()
+			if _, ok := api.divert(logger, conf, httpClients, c.target, &target, notification, src); !ok {
+				api.deadLetter(logger, c.target, &target, notification, src, "circuit breaker open")
+			}
+			continue
+		}
+
+		var (
+			robotResp *models.DingTalkNotificationResponse
+			err       error
+		)
+		if limiter != nil {
+			err = limiter.Wait(ctx, 0)
+		}
+		if err != nil {
+			api.release(c.target)
+		} else {
+			robotResp, err = api.send(ctx, logger, conf, httpClients[c.target], c.target, &target, notification, src)
+		}
+		if ctx.Err() != nil {
+			api.requeueCoalesced(logger, c.target, notifications, i, merged)
+			return
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to send coalesced notification", "err", err)
+			api.failover(logger, conf, httpClients, c.target, &target, notification, src, failureDescription(robotResp, err))
+			continue
+		}
+		if robotResp.ErrorCode != 0 {
+			level.Error(logger).Log("msg", "Failed to send coalesced notification to DingTalk", "respCode", robotResp.ErrorCode, "respMsg", robotResp.ErrorMessage)
+			api.failover(logger, conf, httpClients, c.target, &target, notification, src, failureDescription(robotResp, nil))
+		}
+	}
+}
+
+// requeueCoalesced queues the coalesced notifications from the given one on,
+// which could not be sent before shutdown. They are lost without a storage
+// path.
+func (api *API) requeueCoalesced(logger log.Logger, name string, notifications []*models.DingTalkNotification, from int, merged history.Source) {
+	if api.storagePath == "" {
+		level.Warn(logger).Log("msg", "Dropping coalesced notifications on shutdown, no storage path is configured", "count", len(notifications)-from)
+		return
+	}
+	for i := from; i < len(notifications); i++ {
+		if err := api.enqueue(name, notifications[i], merged.WithDeliveryID(name, i)); err != nil {
+			level.Error(logger).Log("msg", "Failed to enqueue coalesced notification on shutdown", "err", err)
+		}
+	}
+	level.Info(logger).Log("msg", "Queued coalesced notifications on shutdown", "count", len(notifications)-from)
+}
+
+// saveCoalesced keeps the notifications held by c from being lost on
+// shutdown: they are queued, to be sent once restarted, when there is a
+// storage path, or else sent right away regardless of the rate limit.
+func (api *API) saveCoalesced(c *coalescer) {
+	logger := log.With(api.logger, "target", c.target)
+	if api.storagePath != "" {
+		for i, notification := range c.pending {
+			if err := api.enqueue(c.target, notification, c.sources[i]); err != nil {
+				level.Error(logger).Log("msg", "Failed to enqueue coalesced notification on shutdown", "err", err)
+			}
+		}
+		level.Info(logger).Log("msg", "Queued coalesced notifications on shutdown", "count", len(c.pending))
+		return
+	}
+
+	api.mtx.RLock()
+	timeout := api.conf.RequestTimeout
+	api.mtx.RUnlock()
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	api.sendCoalesced(ctx, c, nil)
+}
+
+// stopCoalescers cancels pending flushes and saves the notifications they
+// hold.
+func (api *API) stopCoalescers() {
+	api.coalesceMtx.Lock()
+	var stopped []*coalescer
+	for name, c := range api.coalescers {
+		if c.timer.Stop() {
+			delete(api.coalescers, name)
+			stopped = append(stopped, c)
+			api.wg.Done()
+		}
+	}
+	api.coalesceMtx.Unlock()
+
+	for _, c := range stopped {
+		api.saveCoalesced(c)
+	}
+}
@@ -0,0 +1,136 @@
+package dingtalk
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
+)
+
+// Resend sends the notification of the history with the given ID again, to
+// the same target with its current settings. Queueing, deduplication and
+// coalescing are bypassed, while the rate limit of the target is honored.
+func (api *API) Resend(ctx context.Context, id uint64) (*history.ResendResult, error) {
+	if api.history == nil {
+		return nil, history.ErrDisabled
+	}
+
+	e, err := api.history.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return api.resend(ctx, e)
+}
+
+// Replay resends the notifications to the target which failed between start
+// and end, oldest first. Only the latest failed attempt of each notification
+// is resent, and notifications delivered eventually, whether by a retry, to
+// a fallback target or by an earlier replay, are skipped, so that replaying
+// the same window twice does not notify twice. A zero end means up to now.
+func (api *API) Replay(ctx context.Context, name string, start, end time.Time) ([]history.ResendResult, error) {
+	if api.history == nil {
+		return nil, history.ErrDisabled
+	}
+
+	// Deliveries happen after the failures they make up for, possibly to
+	// fallback targets, so neither the end nor the target bound the query.
+	entries, err := api.history.Query(history.Query{Start: start})
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries are sorted newest first, so a notification is known to be
+	// delivered by the time its failures are seen.
+	var (
+		delivered = map[string]struct{}{}
+		seen      = map[string]struct{}{}
+		failed    []*history.Entry
+	)
+	for _, e := range entries {
+		key := deliveryKey(e)
+		if e.Success {
+			delivered[key] = struct{}{}
+			continue
+		}
+		if e.Target != name || (!end.IsZero() && e.Time.After(end)) {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if _, ok := delivered[key]; !ok {
+			failed = append(failed, e)
+		}
+	}
+
+	results := make([]history.ResendResult, 0, len(failed))
+	for i := len(failed) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		result, err := api.resend(ctx, failed[i])
+		if err != nil {
+			return results, err
+		}
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+// deliveryKey identifies the notification an entry is an attempt to deliver.
+// Entries recorded before delivery IDs existed are only related to their
+// resends.
+func deliveryKey(e *history.Entry) string {
+	if e.DeliveryID != "" {
+		return e.DeliveryID
+	}
+	id := e.ID
+	if e.ResendOf != 0 {
+		id = e.ResendOf
+	}
+	return "#" + strconv.FormatUint(id, 10)
+}
+
+func (api *API) resend(ctx context.Context, e *history.Entry) (*history.ResendResult, error) {
+	api.mtx.RLock()
+	target, ok := api.targets[e.Target]
+	conf := api.conf
+	httpClient := api.httpClients[e.Target]
+	api.mtx.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", history.ErrTargetNotFound, e.Target)
+	}
+
+	if limiter := api.limiterFor(&target); limiter != nil {
+		if err := limiter.Wait(ctx, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	// Resends of resends refer to the original notification.
+	src := e.Source
+	if src.ResendOf == 0 {
+		src.ResendOf = e.ID
+	}
+	logger := log.With(api.logger, "target", e.Target, "resendOf", src.ResendOf)
+	robotResp, err := api.send(ctx, logger, conf, httpClient, e.Target, &target, e.Notification, src)
+
+	result := &history.ResendResult{
+		ID:       e.ID,
+		Target:   e.Target,
+		Response: robotResp,
+	}
+	switch {
+	case err != nil:
+		result.Error = err.Error()
+	case robotResp.ErrorCode == 0:
+		result.Success = true
+	}
+	return result, nil
+}
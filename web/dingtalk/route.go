@@ -0,0 +1,87 @@
+package dingtalk
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/models"
+)
+
+// redeliveryTTL is how long the targets notified by a routed webhook which
+// failed for other targets are remembered, for the sender to post it again.
+const redeliveryTTL = 10 * time.Minute
+
+// dispatch is a message to be sent to a target.
+type dispatch struct {
+	target  string
+	message *models.WebhookMessage
+}
+
+// routeMessage routes each alert of the message through the routing tree and
+// returns one message per target, holding the alerts routed to that target.
+func routeMessage(route *config.Route, m *models.WebhookMessage) []dispatch {
+	var (
+		order  []string
+		alerts = map[string]models.Alerts{}
+	)
+	for _, alert := range m.Alerts {
+		seen := map[string]struct{}{}
+		for _, target := range route.Match(alert.Labels) {
+			if _, ok := seen[target]; ok {
+				continue
+			}
+			seen[target] = struct{}{}
+
+			if _, ok := alerts[target]; !ok {
+				order = append(order, target)
+			}
+			alerts[target] = append(alerts[target], alert)
+		}
+	}
+
+	dispatches := make([]dispatch, 0, len(order))
+	for _, target := range order {
+		dispatches = append(dispatches, dispatch{
+			target:  target,
+			message: subMessage(m, alerts[target]),
+		})
+	}
+	return dispatches
+}
+
+// subMessage returns a copy of the message holding only the given alerts.
+func subMessage(m *models.WebhookMessage, alerts models.Alerts) *models.WebhookMessage {
+	sub := *m
+	sub.Alerts = alerts
+	sub.AtMobiles = append([]string(nil), m.AtMobiles...)
+	sub.AtUserIds = append([]string(nil), m.AtUserIds...)
+
+	sub.Status = string(model.AlertResolved)
+	if len(alerts.Firing()) > 0 {
+		sub.Status = string(model.AlertFiring)
+	}
+	return &sub
+}
+
+// redeliveryKey identifies the notification of the routed message to the
+// target in the dedup cache, apart from the keys used for deduplication.
+func redeliveryKey(target string, m *models.WebhookMessage) string {
+	return "redelivery:" + dedupKey(target, m)
+}
+
+// settleRedelivery records the targets notified by a routed webhook when some
+// other target failed, so that the payload posted again by the sender only
+// reaches the targets which failed. Once the webhook succeeds, they are
+// forgotten and later notifications of the same alerts, such as repeated ones,
+// go through.
+func (api *API) settleRedelivery(notified []string, failed bool) {
+	for _, key := range notified {
+		if failed {
+			api.dedup.remember(key, redeliveryTTL)
+		} else {
+			api.dedup.release(key)
+		}
+	}
+}
@@ -2,7 +2,7 @@ import React from 'react';
 import Navigation from './Navbar';
 import { Container } from 'reactstrap';
 import { Redirect, Router } from '@reach/router';
-import { Config, Flags, Playground, Status } from './pages';
+import { Config, Flags, History, Playground, Status, Targets } from './pages';
 import './App.css';
 
 const App: React.FC = () => {
@@ -21,6 +21,8 @@ const App: React.FC = () => {
           <Config path="/config" />
           <Flags path="/flags" />
           <Status path="/status" />
+          <Targets path="/targets" />
+          <History path="/history" />
         </Router>
       </Container>
     </>
@@ -30,6 +30,11 @@ const Navigation: FC = () => {
               Playground
             </NavLink>
           </NavItem>
+          <NavItem>
+            <NavLink tag={Link} to="/ui/history">
+              History
+            </NavLink>
+          </NavItem>
           <UncontrolledDropdown nav inNavbar>
             <DropdownToggle nav caret>
               Status
@@ -38,6 +43,9 @@ const Navigation: FC = () => {
               <DropdownItem tag={Link} to="/ui/status">
                 Runtime & Build Information
               </DropdownItem>
+              <DropdownItem tag={Link} to="/ui/targets">
+                Target Health
+              </DropdownItem>
               <DropdownItem tag={Link} to="/ui/flags">
                 Command-Line Flags
               </DropdownItem>
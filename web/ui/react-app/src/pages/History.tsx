@@ -0,0 +1,186 @@
+import React, { FC, FormEvent, Fragment, useState } from 'react';
+import { RouteComponentProps } from '@reach/router';
+import { Badge, Button, Col, Form, FormGroup, Input, Label, Row, Table } from 'reactstrap';
+import { withStatusIndicator } from '../withStatusIndicator';
+import { useFetch } from '../utils/useFetch';
+
+export interface Notification {
+  id: number;
+  time: string;
+  target: string;
+  status: string;
+  groupKey: string;
+  groupLabels: { [k: string]: string };
+  fingerprints: string[];
+  title: string;
+  text: string;
+  success: boolean;
+  response?: { errcode: number; errmsg: string };
+  error?: string;
+  latency: number;
+  attempts: number;
+}
+
+interface HistoryProps {
+  data?: Notification[];
+}
+
+const formatResult = (n: Notification) => {
+  if (n.error) {
+    return n.error;
+  }
+  if (n.response && n.response.errcode !== 0) {
+    return `${n.response.errcode}: ${n.response.errmsg}`;
+  }
+  return '';
+};
+
+export const HistoryContent: FC<HistoryProps> = ({ data = [] }) => {
+  const [expanded, setExpanded] = useState<number>();
+
+  if (data.length === 0) {
+    return <p>No notifications found.</p>;
+  }
+
+  return (
+    <Table size="sm" bordered striped>
+      <thead>
+        <tr>
+          <th>Time</th>
+          <th>Target</th>
+          <th>Status</th>
+          <th>Title</th>
+          <th>Result</th>
+          <th>Attempts</th>
+          <th>Latency</th>
+        </tr>
+      </thead>
+      <tbody>
+        {data.map((n) => (
+          <Fragment key={n.id}>
+            <tr style={{ cursor: 'pointer' }} onClick={() => setExpanded(expanded === n.id ? undefined : n.id)}>
+              <td className="text-nowrap">{new Date(n.time).toUTCString()}</td>
+              <td>{n.target}</td>
+              <td>{n.status}</td>
+              <td className="text-break">{n.title}</td>
+              <td>
+                <Badge color={n.success ? 'success' : 'danger'}>{n.success ? 'sent' : 'failed'}</Badge>{' '}
+                {formatResult(n)}
+              </td>
+              <td>{n.attempts}</td>
+              <td>{n.latency.toFixed(3)}s</td>
+            </tr>
+            {expanded === n.id && (
+              <tr>
+                <td colSpan={7}>
+                  <div>
+                    <strong>Group labels:</strong>{' '}
+                    {Object.entries(n.groupLabels || {})
+                      .map(([k, v]) => `${k}="${v}"`)
+                      .join(', ')}
+                  </div>
+                  <div>
+                    <strong>Fingerprints:</strong> {(n.fingerprints || []).join(', ')}
+                  </div>
+                  <pre className="mt-2 mb-0 text-break" style={{ whiteSpace: 'pre-wrap' }}>
+                    {n.text}
+                  </pre>
+                </td>
+              </tr>
+            )}
+          </Fragment>
+        ))}
+      </tbody>
+    </Table>
+  );
+};
+const HistoryWithStatusIndicator = withStatusIndicator(HistoryContent);
+
+HistoryContent.displayName = 'History';
+
+const initialFilters = {
+  target: '',
+  status: '',
+  success: '',
+  search: '',
+  limit: '100',
+};
+
+const History: FC<RouteComponentProps> = () => {
+  const [inputs, setInputs] = useState(initialFilters);
+  const [filters, setFilters] = useState(initialFilters);
+
+  const params = new URLSearchParams();
+  Object.entries(filters).forEach(([k, v]) => {
+    if (v !== '') {
+      params.set(k, v);
+    }
+  });
+  const { response, error, isLoading } = useFetch<Notification[]>(`/api/v1/notifications?${params.toString()}`);
+
+  const handleChange = (e: React.ChangeEvent<HTMLInputElement>) => {
+    setInputs({ ...inputs, [e.target.name]: e.target.value });
+  };
+  const handleSubmit = (e: FormEvent) => {
+    e.preventDefault();
+    setFilters(inputs);
+  };
+
+  return (
+    <>
+      <h2>Notification History</h2>
+      <Form onSubmit={handleSubmit}>
+        <Row form>
+          <Col md={2}>
+            <FormGroup>
+              <Label for="target">Target</Label>
+              <Input id="target" name="target" value={inputs.target} onChange={handleChange} />
+            </FormGroup>
+          </Col>
+          <Col md={2}>
+            <FormGroup>
+              <Label for="status">Status</Label>
+              <Input type="select" id="status" name="status" value={inputs.status} onChange={handleChange}>
+                <option value="">Any</option>
+                <option value="firing">Firing</option>
+                <option value="resolved">Resolved</option>
+              </Input>
+            </FormGroup>
+          </Col>
+          <Col md={2}>
+            <FormGroup>
+              <Label for="success">Result</Label>
+              <Input type="select" id="success" name="success" value={inputs.success} onChange={handleChange}>
+                <option value="">Any</option>
+                <option value="true">Sent</option>
+                <option value="false">Failed</option>
+              </Input>
+            </FormGroup>
+          </Col>
+          <Col md={3}>
+            <FormGroup>
+              <Label for="search">Search</Label>
+              <Input id="search" name="search" value={inputs.search} onChange={handleChange} />
+            </FormGroup>
+          </Col>
+          <Col md={1}>
+            <FormGroup>
+              <Label for="limit">Limit</Label>
+              <Input type="number" min={1} id="limit" name="limit" value={inputs.limit} onChange={handleChange} />
+            </FormGroup>
+          </Col>
+          <Col md={2} className="d-flex align-items-end">
+            <FormGroup>
+              <Button color="primary" type="submit">
+                Search
+              </Button>
+            </FormGroup>
+          </Col>
+        </Row>
+      </Form>
+      <HistoryWithStatusIndicator data={response.data} error={error} isLoading={isLoading} />
+    </>
+  );
+};
+
+export default History;
@@ -33,7 +33,10 @@ export const statusConfig: StatusConfig = {
     title: 'Configuration reload',
     customizeValue: (v: boolean) => (v ? 'Successful' : 'Unsuccessful'),
   },
-  lastConfigTime: { title: 'Last successful configuration reload' },
+  lastConfigTime: {
+    title: 'Last successful configuration reload',
+    customizeValue: (v: string) => new Date(v).toUTCString(),
+  },
   goroutineCount: { title: 'Goroutines' },
 };
 
@@ -0,0 +1,90 @@
+import React, { FC } from 'react';
+import { RouteComponentProps } from '@reach/router';
+import { Badge, Table } from 'reactstrap';
+import { withStatusIndicator } from '../withStatusIndicator';
+import { useFetch } from '../utils/useFetch';
+
+export interface TargetStatus {
+  name: string;
+  circuitBreaker: boolean;
+  state: string;
+  consecutiveFailures: number;
+  lastError?: string;
+  lastErrorTime?: string;
+  lastSuccessTime?: string;
+  retryTime?: string;
+}
+
+interface TargetsProps {
+  data?: TargetStatus[];
+}
+
+const stateColors: { [k: string]: string } = {
+  closed: 'success',
+  'half-open': 'warning',
+  open: 'danger',
+};
+
+const formatTime = (t?: string) => (t ? new Date(t).toUTCString() : '-');
+
+export const TargetsContent: FC<TargetsProps> = ({ data = [] }) => {
+  if (data.length === 0) {
+    return <p>No targets configured.</p>;
+  }
+
+  return (
+    <Table size="sm" bordered striped>
+      <thead>
+        <tr>
+          <th>Target</th>
+          <th>Circuit</th>
+          <th>Consecutive failures</th>
+          <th>Last success</th>
+          <th>Last error</th>
+          <th>Retry at</th>
+        </tr>
+      </thead>
+      <tbody>
+        {data.map((t) => (
+          <tr key={t.name}>
+            <td>{t.name}</td>
+            <td>
+              {t.circuitBreaker ? (
+                <Badge color={stateColors[t.state] || 'secondary'}>{t.state}</Badge>
+              ) : (
+                <Badge color="secondary">disabled</Badge>
+              )}
+            </td>
+            <td>{t.consecutiveFailures}</td>
+            <td className="text-nowrap">{formatTime(t.lastSuccessTime)}</td>
+            <td className="text-break">
+              {t.lastError ? (
+                <>
+                  {formatTime(t.lastErrorTime)}: {t.lastError}
+                </>
+              ) : (
+                '-'
+              )}
+            </td>
+            <td className="text-nowrap">{formatTime(t.retryTime)}</td>
+          </tr>
+        ))}
+      </tbody>
+    </Table>
+  );
+};
+const TargetsWithStatusIndicator = withStatusIndicator(TargetsContent);
+
+TargetsContent.displayName = 'Targets';
+
+const Targets: FC<RouteComponentProps> = () => {
+  const { response, error, isLoading } = useFetch<TargetStatus[]>('/api/v1/status/targets');
+  return (
+    <>
+      <h2>Target Health</h2>
+      <TargetsWithStatusIndicator data={response.data} error={error} isLoading={isLoading} />
+    </>
+  );
+};
+
+export default Targets;
@@ -1,6 +1,8 @@
 import Config from './Config';
 import Flags from './Flags';
+import History from './History';
 import Status from './Status';
 import Playground from './Playground';
+import Targets from './Targets';
 
-export { Config, Status, Flags, Playground };
+export { Config, Status, Flags, History, Playground, Targets };
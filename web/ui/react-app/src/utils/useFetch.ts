@@ -8,7 +8,7 @@ export interface FetchState<T> {
   isLoading: boolean;
 }
 
-export const useFetch = <T extends Record<string, unknown>>(url: string, options?: RequestInit): FetchState<T> => {
+export const useFetch = <T>(url: string, options?: RequestInit): FetchState<T> => {
   const [response, setResponse] = useState<APIResponse<T>>({ status: 'start fetching' });
   const [error, setError] = useState<Error>();
   const [isLoading, setIsLoading] = useState<boolean>(false);
@@ -15,6 +15,7 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -31,10 +32,13 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/server"
 	"go.uber.org/atomic"
 
 	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+	"github.com/timonwong/prometheus-webhook-dingtalk/pkg/history"
 	"github.com/timonwong/prometheus-webhook-dingtalk/template"
 	"github.com/timonwong/prometheus-webhook-dingtalk/web/apiv1"
 	"github.com/timonwong/prometheus-webhook-dingtalk/web/dingtalk"
@@ -48,6 +52,8 @@ var reactRouterPaths = []string{
 	"/config",
 	"/flags",
 	"/status",
+	"/targets",
+	"/history",
 }
 
 // Options for the web Handler.
@@ -55,8 +61,16 @@ type Options struct {
 	ListenAddress   string
 	EnableWebUI     bool
 	EnableLifecycle bool
-	Version         *VersionInfo
-	Flags           map[string]string
+	// EnableAdminAPI enables resending and replaying notifications.
+	EnableAdminAPI bool
+	StoragePath    string
+	// Bounds of the notification history kept under StoragePath.
+	HistoryRetention  time.Duration
+	HistoryMaxEntries int
+	WebConfigFile     string
+	Coordinator       *config.Coordinator
+	Version           *VersionInfo
+	Flags             map[string]string
 }
 
 type VersionInfo = apiv1.VersionInfo
@@ -67,6 +81,9 @@ type Handler struct {
 
 	apiV1    *apiv1.API
 	dingTalk *dingtalk.API
+	auth     *authenticator
+	// webConfigs caches the web configuration file.
+	webConfigs *webConfigLoader
 
 	router      chi.Router
 	reloadCh    chan chan error
@@ -95,6 +112,8 @@ func New(logger log.Logger, o *Options) *Handler {
 	h := &Handler{
 		logger: logger,
 
+		auth:        newAuthenticator(),
+		webConfigs:  newWebConfigLoader(o.WebConfigFile),
 		router:      router,
 		reloadCh:    make(chan chan error),
 		options:     o,
@@ -103,6 +122,10 @@ func New(logger log.Logger, o *Options) *Handler {
 		cwd:         cwd,
 	}
 
+	h.dingTalk = dingtalk.NewAPI(logger, o.StoragePath, history.Options{
+		Retention:  o.HistoryRetention,
+		MaxEntries: o.HistoryMaxEntries,
+	}, prometheus.DefaultRegisterer)
 	h.apiV1 = apiv1.NewAPI(
 		logger,
 		func() *config.Config {
@@ -116,12 +139,20 @@ func New(logger log.Logger, o *Options) *Handler {
 			return h.tmpl
 		},
 		o.Flags,
+		o.EnableAdminAPI,
 		h.versionInfo,
 		h.runtimeInfo,
+		h.reloadHistory,
+		h.targetStatus,
+		h.dingTalk.SendTest,
+		h.dingTalk.Notifications,
+		h.dingTalk.Resend,
+		h.dingTalk.Replay,
 	)
-	h.dingTalk = dingtalk.NewAPI(logger)
 
-	router.Mount("/dingtalk", h.dingTalk.Routes())
+	router.Use(h.checkAuth)
+	router.Mount("/dingtalk", h.dingTalk.Routes(h.checkTargetAuth))
+	router.Get("/metrics", promhttp.Handler().ServeHTTP)
 
 	if o.EnableLifecycle {
 		router.Post("/-/reload", h.reload)
@@ -197,18 +228,19 @@ func (h *Handler) ApplyConfig(conf *config.Config, tmpl *template.Template) erro
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
 
+	if err := h.dingTalk.Update(conf, tmpl); err != nil {
+		return err
+	}
 	h.config = conf
 	h.tmpl = tmpl
-	h.dingTalk.Update(conf, tmpl)
 	return nil
 }
 
 // Run serves the HTTP endpoints.
 func (h *Handler) Run(ctx context.Context) error {
-	level.Info(h.logger).Log("msg", "Start listening for connections", "address", h.options.ListenAddress)
-	listener, err := net.Listen("tcp", h.options.ListenAddress)
+	webConfig, err := h.webConfigs.load()
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid web configuration file: %w", err)
 	}
 
 	errlog := stdlog.New(log.NewStdlibAdapter(level.Error(h.logger)), "", 0)
@@ -217,20 +249,90 @@ func (h *Handler) Run(ctx context.Context) error {
 		ErrorLog: errlog,
 	}
 
+	useTLS := webConfig.TLSConfig.Enabled()
+	if useTLS {
+		if httpSrv.TLSConfig, err = h.serverTLSConfig(webConfig); err != nil {
+			return fmt.Errorf("invalid TLS configuration: %w", err)
+		}
+		if !webConfig.HTTPConfig.HTTP2 {
+			httpSrv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	}
+
+	level.Info(h.logger).Log("msg", "Start listening for connections", "address", h.options.ListenAddress, "tls", useTLS)
+	listener, err := net.Listen("tcp", h.options.ListenAddress)
+	if err != nil {
+		return err
+	}
+
 	errCh := make(chan error)
 	go func() {
-		errCh <- httpSrv.Serve(listener)
+		if useTLS {
+			errCh <- httpSrv.ServeTLS(listener, "", "")
+		} else {
+			errCh <- httpSrv.Serve(listener)
+		}
 	}()
 
 	select {
 	case e := <-errCh:
+		h.dingTalk.Close()
 		return e
 	case <-ctx.Done():
 		httpSrv.Shutdown(ctx)
+		h.dingTalk.Close()
 		return nil
 	}
 }
 
+// serverTLSConfig returns the TLS configuration of the server. Changes to the
+// web configuration file and renewed certificates are picked up on the next
+// handshake without a restart. The last valid configuration is kept when it
+// becomes invalid.
+func (h *Handler) serverTLSConfig(webConfig *WebConfig) (*tls.Config, error) {
+	initial, err := h.webConfigs.loadTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	nextProtos := []string{"http/1.1"}
+	if webConfig.HTTPConfig.HTTP2 {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+	withProtos := func(c *tls.Config) *tls.Config {
+		c = c.Clone()
+		c.NextProtos = nextProtos
+		return c
+	}
+
+	var (
+		mtx     sync.Mutex
+		built   = initial
+		last    = withProtos(initial)
+		lastErr error
+	)
+	cfg := last.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		tlsConfig, err := h.webConfigs.loadTLS()
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch {
+		case err != nil:
+			// The loader keeps returning the same error until the files
+			// change, it is only logged once.
+			if lastErr == nil || err.Error() != lastErr.Error() {
+				level.Error(h.logger).Log("msg", "Unable to reload TLS configuration, keeping the previous one", "err", err)
+			}
+		case tlsConfig != built:
+			built, last = tlsConfig, withProtos(tlsConfig)
+		}
+		lastErr = err
+		return last, nil
+	}
+	return cfg, nil
+}
+
 // Reload returns the receive-only channel that signals configuration reload requests.
 func (h *Handler) Reload() <-chan chan error {
 	return h.reloadCh
@@ -278,5 +380,44 @@ func (h *Handler) runtimeInfo() (*apiv1.RuntimeInfo, error) {
 		GOGC:           os.Getenv("GOGC"),
 		GODEBUG:        os.Getenv("GODEBUG"),
 	}
+	if h.options.Coordinator != nil {
+		last, lastSuccess := h.options.Coordinator.LastReload()
+		status.ReloadConfigSuccess = last != nil && last.Success
+		if lastSuccess != nil {
+			status.LastConfigTime = lastSuccess.Time
+		}
+	}
 	return status, nil
 }
+
+func (h *Handler) targetStatus() []apiv1.TargetStatus {
+	health := h.dingTalk.Health()
+	statuses := make([]apiv1.TargetStatus, 0, len(health))
+	for _, t := range health {
+		statuses = append(statuses, apiv1.TargetStatus{
+			Name:                t.Name,
+			CircuitBreaker:      t.CircuitBreaker,
+			State:               t.Status.State.String(),
+			ConsecutiveFailures: t.Status.ConsecutiveFailures,
+			LastError:           t.Status.LastError,
+			LastErrorTime:       timeOrNil(t.Status.LastErrorTime),
+			LastSuccessTime:     timeOrNil(t.Status.LastSuccessTime),
+			RetryTime:           timeOrNil(t.Status.RetryTime),
+		})
+	}
+	return statuses
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (h *Handler) reloadHistory() []config.ReloadEvent {
+	if h.options.Coordinator == nil {
+		return []config.ReloadEvent{}
+	}
+	return h.options.Coordinator.ReloadHistory()
+}
@@ -0,0 +1,257 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+
+	"github.com/timonwong/prometheus-webhook-dingtalk/config"
+)
+
+// WebConfig is the configuration of the web server. Its format is compatible
+// with the web configuration file of the Prometheus exporter toolkit.
+type WebConfig struct {
+	TLSConfig  TLSServerConfig  `yaml:"tls_server_config"`
+	HTTPConfig HTTPServerConfig `yaml:"http_server_config"`
+	// Users maps usernames to bcrypt hashed passwords.
+	Users map[string]config.Secret `yaml:"basic_auth_users"`
+}
+
+// TLSServerConfig configures TLS termination, it is disabled unless a
+// certificate is configured.
+type TLSServerConfig struct {
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	ClientAuth   string   `yaml:"client_auth_type"`
+	ClientCAs    string   `yaml:"client_ca_file"`
+	CipherSuites []cipher `yaml:"cipher_suites"`
+	// PreferServerCipherSuites is only accepted for compatibility, Go picks
+	// the cipher suite by itself.
+	PreferServerCipherSuites bool       `yaml:"prefer_server_cipher_suites"`
+	MinVersion               tlsVersion `yaml:"min_version"`
+	MaxVersion               tlsVersion `yaml:"max_version"`
+}
+
+// HTTPServerConfig configures the HTTP server.
+type HTTPServerConfig struct {
+	// HTTP2 enables HTTP/2, which is only available with TLS.
+	HTTP2 bool `yaml:"http2"`
+}
+
+// LoadWebConfig loads the web configuration file, an empty path yields an
+// empty configuration. Relative paths in the file are resolved against the
+// directory of the file.
+func LoadWebConfig(path string) (*WebConfig, error) {
+	c := &WebConfig{
+		TLSConfig: TLSServerConfig{
+			MinVersion: tls.VersionTLS12,
+			MaxVersion: tls.VersionTLS13,
+		},
+		HTTPConfig: HTTPServerConfig{HTTP2: true},
+	}
+	if path == "" {
+		return c, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, err
+	}
+
+	for user, hash := range c.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for user %q: %w", user, err)
+		}
+	}
+
+	dir := filepath.Dir(path)
+	c.TLSConfig.CertFile = config.JoinDir(dir, c.TLSConfig.CertFile)
+	c.TLSConfig.KeyFile = config.JoinDir(dir, c.TLSConfig.KeyFile)
+	c.TLSConfig.ClientCAs = config.JoinDir(dir, c.TLSConfig.ClientCAs)
+	return c, nil
+}
+
+// Enabled reports whether TLS is configured.
+func (c *TLSServerConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// TLSConfig builds the TLS configuration, reading the certificate, key and
+// client CA files.
+func (c *TLSServerConfig) TLSConfig() (*tls.Config, error) {
+	if c.CertFile == "" {
+		return nil, errors.New("missing cert_file")
+	}
+	if c.KeyFile == "" {
+		return nil, errors.New("missing key_file")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load X509KeyPair: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   uint16(c.MinVersion),
+		MaxVersion:   uint16(c.MaxVersion),
+		Certificates: []tls.Certificate{cert},
+	}
+	for _, cs := range c.CipherSuites {
+		cfg.CipherSuites = append(cfg.CipherSuites, uint16(cs))
+	}
+
+	if c.ClientCAs != "" {
+		pem, err := os.ReadFile(c.ClientCAs)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client_ca_file %q", c.ClientCAs)
+		}
+		cfg.ClientCAs = pool
+	}
+
+	switch c.ClientAuth {
+	case "RequestClientCert":
+		cfg.ClientAuth = tls.RequestClientCert
+	case "RequireAnyClientCert", "RequireClientCert": // Preserved for backwards compatibility.
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	case "VerifyClientCertIfGiven":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "RequireAndVerifyClientCert":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "", "NoClientCert":
+		cfg.ClientAuth = tls.NoClientCert
+	default:
+		return nil, fmt.Errorf("invalid client_auth_type %q", c.ClientAuth)
+	}
+	if c.ClientCAs != "" && cfg.ClientAuth == tls.NoClientCert {
+		return nil, errors.New("client_ca_file configured without a client_auth_type verifying client certificates")
+	}
+	if c.ClientCAs == "" && (cfg.ClientAuth == tls.VerifyClientCertIfGiven || cfg.ClientAuth == tls.RequireAndVerifyClientCert) {
+		return nil, fmt.Errorf("client_auth_type %q requires client_ca_file", c.ClientAuth)
+	}
+	return cfg, nil
+}
+
+// webConfigLoader caches the web configuration file and the TLS configuration
+// built from it, until one of the files they are read from changes, as told
+// by its modification time and size.
+type webConfigLoader struct {
+	path string
+
+	mtx       sync.Mutex
+	webStamp  string
+	webConfig *WebConfig
+	webErr    error
+	tlsStamp  string
+	tlsConfig *tls.Config
+	tlsErr    error
+}
+
+func newWebConfigLoader(path string) *webConfigLoader {
+	return &webConfigLoader{path: path}
+}
+
+// load returns the web configuration, the file is only read again once it
+// changed.
+func (l *webConfigLoader) load() (*WebConfig, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.loadLocked()
+}
+
+func (l *webConfigLoader) loadLocked() (*WebConfig, error) {
+	stamp := fileStamp(l.path)
+	if stamp != l.webStamp || (l.webConfig == nil && l.webErr == nil) {
+		l.webConfig, l.webErr = LoadWebConfig(l.path)
+		l.webStamp = stamp
+	}
+	return l.webConfig, l.webErr
+}
+
+// loadTLS returns the TLS configuration, it is only built again once the web
+// configuration file or the certificate, key or client CA files changed.
+func (l *webConfigLoader) loadTLS() (*tls.Config, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	webConfig, err := l.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	c := &webConfig.TLSConfig
+	if !c.Enabled() {
+		return nil, errors.New("TLS is no longer enabled")
+	}
+
+	stamp := strings.Join([]string{l.webStamp, fileStamp(c.CertFile), fileStamp(c.KeyFile), fileStamp(c.ClientCAs)}, "|")
+	if stamp != l.tlsStamp || (l.tlsConfig == nil && l.tlsErr == nil) {
+		l.tlsConfig, l.tlsErr = c.TLSConfig()
+		l.tlsStamp = stamp
+	}
+	return l.tlsConfig, l.tlsErr
+}
+
+// fileStamp identifies the version of a file by its modification time and
+// size, it is empty for an empty path.
+func fileStamp(path string) string {
+	if path == "" {
+		return ""
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%d:%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+type cipher uint16
+
+func (c *cipher) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == s {
+			*c = cipher(cs.ID)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown cipher suite %q", s)
+}
+
+type tlsVersion uint16
+
+var tlsVersions = map[string]tlsVersion{
+	"TLS13": tls.VersionTLS13,
+	"TLS12": tls.VersionTLS12,
+	"TLS11": tls.VersionTLS11,
+	"TLS10": tls.VersionTLS10,
+}
+
+func (tv *tlsVersion) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		return fmt.Errorf("unknown TLS version %q", s)
+	}
+	*tv = v
+	return nil
+}